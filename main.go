@@ -1,376 +1,552 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/xml"
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
-	"regexp"
+	"net/http/pprof"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/model"
+
+	"github.com/pteichman/sonos_exporter/sonos"
 )
 
 var (
-	flagAddress = flag.String("address", "localhost:1915", "Listen address")
-
-	collectionDuration = prometheus.NewDesc(
-		"sonos_collection_duration",
-		"Total collection time",
-		nil,
-		nil,
-	)
-
-	collectionErrors = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "sonos_collection_errors_total",
-			Help: "Errors observed when collecting devices",
+	flagAddress        = flag.String("address", "localhost:1915", "Listen address")
+	flagTargets        = flag.String("targets", "", "Comma separated speakers (host[:port][;timeout=3s]) to collect instead of discovering them via SSDP")
+	flagDiscoveryTTL   = flag.Duration("discovery-ttl", 0, "How long to reuse discovered speakers; 0 to discover on every scrape")
+	flagDiscoveryJit   = flag.Float64("discovery-jitter", 0.1, "Random fraction to vary each -discovery-ttl by")
+	flagHTTPTimeout    = flag.Duration("http-timeout", 5*time.Second, "Timeout for each request to a speaker; 0 for none")
+	flagRedirects      = flag.Bool("follow-redirects", true, "Follow HTTP redirects from speakers")
+	flagExcludeIfaces  = flag.String("exclude-interfaces", "", "Comma separated network interfaces to leave out (e.g. lo)")
+	flagFake           = flag.Int("fake", 0, "Serve N synthetic speakers instead of real ones, labeled fake=\"true\"")
+	flagEnablePprof    = flag.Bool("enable-pprof", false, "Serve debug endpoints: net/http/pprof under /debug/pprof/ and POST /-/refresh-discovery")
+	flagMaxConcurrency = flag.Int("max-concurrency", 0, "Most speakers to collect at once; 0 for no limit")
+	flagScrapeTimeout  = flag.Duration("scrape-timeout", 0, "Deadline for a whole scrape; 0 for none")
+	flagCollectAlarms  = flag.Bool("collect-alarms", false, "Collect each household's alarms")
+	flagTopology       = flag.Bool("collect-topology", false, "Collect each household's groups, labeling playback metrics with the coordinator's room")
+	flagModelIntervals = flag.String("model-intervals", "", "Comma separated model=interval pairs; matching speakers are fetched at most once per interval (e.g. S17=5m,S27=5m)")
+	flagUDNAllow       = flag.String("udn-allow", "", "Comma separated UDNs of the only speakers to export (e.g. uuid:RINCON_000E58123456701400)")
+	flagSSDPAllowlist  = flag.Bool("ssdp-require-allowlist", false, "Ignore SSDP responses from speakers not in -udn-allow, without fetching anything from them")
+	flagAllowedSubnets = flag.String("allowed-subnets", "", "Comma separated CIDRs; only speakers whose address is within one are fetched from")
+	flagSSDPTTL        = flag.Int("ssdp-ttl", 1, "Multicast TTL of SSDP searches; raise it to discover speakers across multicast routers")
+	flagSSDPBackoff    = flag.Duration("ssdp-backoff", 50*time.Millisecond, "First wait after a transient SSDP read error; doubles and is jittered on each further error")
+	flagDiscoveryMode  = flag.String("discovery-mode", "auto", "auto to use -targets if given and SSDP otherwise, or both to use -targets and SSDP")
+	flagMaxResponse    = flag.Int64("max-response-bytes", sonos.DefaultMaxResponseBytes, "Largest response read from a speaker; longer ones fail the fetch (0 for no limit)")
+	flagLenientXML     = flag.Bool("lenient-xml", false, "Tolerate malformed XML from speakers, such as undeclared entities")
+	flagBuckets        = flag.String("duration-buckets", "", "Comma separated buckets in seconds for sonos_collection_duration_seconds (default 0.05,0.1,0.25,0.5,1,2,3,5,10)")
+	flagSeeds          = flag.String("seeds", "", "Comma separated speakers (host[:port]) whose zone group topology lists the speakers to collect")
+	flagResolve        = flag.Bool("resolve-hostnames", false, "Look up each speaker's hostname by reverse DNS for sonos_speaker's hostname label")
+	flagDiscoveryTO    = flag.Duration("discovery-timeout", 0, "Timeout for discovering speakers; 0 for discovery's own limits")
+	flagDeviceTO       = flag.Duration("device-timeout", 0, "Timeout for fetching a device description; 0 for -http-timeout")
+	flagIfconfigTO     = flag.Duration("ifconfig-timeout", 0, "Timeout for fetching ifconfig; 0 for -http-timeout")
+	flagSOAPTO         = flag.Duration("soap-timeout", 0, "Timeout for each SOAP call; 0 for -http-timeout")
+	flagLocalAPI       = flag.Bool("use-local-api", false, "Prefer newer firmware's JSON local API over SOAP where it can answer")
+	flagLocalAPIKey    = flag.String("local-api-key", "", "API key to send the local API with -use-local-api")
+	flagRequireTargets = flag.Bool("require-targets", false, "Discover speakers at startup and exit if there are none")
+	flagSourceIP       = flag.String("source-ip", "", "Local address to make requests to speakers from, on hosts with several")
+	flagRetryEmpty     = flag.Bool("retry-empty-scrape", false, "Retry discovery once when a scrape finds no speakers")
+	flagDeltaMode      = flag.Bool("delta-mode", false, "Experimental: leave info-style gauges unchanged since last sent out of scrapes, timestamping the ones sent")
+	flagLabelTemplate  = flag.String("target-label-template", "", "Go template over the device description making sonos_speaker's target_label (e.g. {{.RoomName}}-{{.ModelNumber}}); the room name if empty")
+	flagStrict         = flag.Bool("strict", false, "Exit at startup on a bad target or -source-ip, or when no speakers are found, instead of logging and carrying on")
+	flagActiveThresh   = flag.Float64("active-threshold", sonos.DefaultActiveThreshold, "Bytes per second of traffic above which sonos_active counts a player as in use")
+	flagStateFile      = flag.String("state-file", "", "File to keep interface counters and reset counts in across restarts")
+	flagProbeLabel     = flag.String("probe-target-label", "probe_target", "Label carrying the target on metrics served by /probe")
+	flagEventing       = flag.Bool("enable-eventing", false, "Subscribe to speakers' AVTransport and RenderingControl events for sonos_transport_state and sonos_volume")
+	flagEventingAddr   = flag.String("eventing-address", ":1916", "Listen address for speakers' event callbacks with -enable-eventing; speakers must be able to reach its port")
+	flagQuiet          = flag.Bool("quiet", false, "Log only errors and warnings, leaving out routine messages such as what each discovery found")
+	flagIfconfigRes    listFlag
+
+	configMaxConcurrency = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sonos_config_max_concurrency",
+			Help: "Configured limit on speakers collected at once, 0 for none",
 		},
 	)
 
-	speakerInfo = prometheus.NewDesc(
-		"sonos_speaker", "Sonos speaker info",
-		[]string{
-			"room_name",
-			"display_version",
-			"hardware_version",
-			"model_name",
-			"model_number",
-			"serial_num",
-			"software_version",
-			"udn",
+	configHTTPTimeout = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sonos_config_http_timeout_seconds",
+			Help: "Configured timeout for each request to a speaker, 0 for none",
 		},
-		nil,
-	)
-
-	rxBytes = prometheus.NewDesc(
-		"sonos_rx_bytes", "Received bytes",
-		[]string{"player", "device"},
-		nil,
 	)
 
-	txBytes = prometheus.NewDesc(
-		"sonos_tx_bytes", "Transmitted bytes",
-		[]string{"player", "device"},
-		nil,
-	)
-
-	rxPackets = prometheus.NewDesc(
-		"sonos_rx_packets", "Received packets",
-		[]string{"player", "device"},
-		nil,
-	)
-
-	txPackets = prometheus.NewDesc(
-		"sonos_tx_packets", "Transmitted packets ",
-		[]string{"player", "device"},
-		nil,
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sonos_http_requests_total",
+			Help: "Requests to the exporter's HTTP server, by path and status code",
+		},
+		[]string{"path", "code"},
 	)
 )
 
 func init() {
-	prometheus.MustRegister(collectionErrors)
-	prometheus.MustRegister(collector{})
+	flag.Var(&flagIfconfigRes, "ifconfig-regexp", "Override an ifconfig stat's regexp as field=regexp, for translated firmware; repeatable")
+	flag.DurationVar(flagHTTPTimeout, "timeout", *flagHTTPTimeout, "Alias for -http-timeout")
 }
 
 func main() {
 	flag.Parse()
 
-	log.Printf("Sonos exporter listening on %s", *flagAddress)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*flagAddress, nil))
-}
-
-type collector struct{}
-
-// Describe implements Prometheus.Collector.
-func (c collector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
-}
-
-// Collect implements Prometheus.Collector.
-func (c collector) Collect(ch chan<- prometheus.Metric) {
-	start := time.Now()
-
-	found, err := Search("urn:schemas-upnp-org:device:ZonePlayer:1")
+	overrides := make(map[string]string)
+	for _, v := range flagIfconfigRes {
+		field, expr, ok := strings.Cut(v, "=")
+		if !ok {
+			log.Fatalf("Bad -ifconfig-regexp %q: not field=regexp", v)
+		}
+		overrides[field] = expr
+	}
+	regexps, err := sonos.CompileIfconfigRegexps(overrides)
 	if err != nil {
-		log.Printf("Search: %s", err)
-		collectionErrors.Inc()
-		return
+		log.Fatalf("Bad -ifconfig-regexp: %s", err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(found))
-
-	for _, dev := range found {
-		go func(dev http.Header) {
-			collect(ch, dev.Get("Location"))
-			wg.Done()
-		}(dev)
+	if *flagDiscoveryJit < 0 || *flagDiscoveryJit >= 1 {
+		log.Fatalf("Bad -discovery-jitter %v: must be in [0, 1)", *flagDiscoveryJit)
 	}
 
-	wg.Wait()
+	if *flagSSDPAllowlist && len(splitList(*flagUDNAllow)) == 0 {
+		log.Fatalf("-ssdp-require-allowlist needs -udn-allow")
+	}
 
-	ch <- prometheus.MustNewConstMetric(
-		collectionDuration,
-		prometheus.GaugeValue,
-		time.Since(start).Seconds(),
-	)
+	if *flagLocalAPI && *flagLocalAPIKey == "" {
+		log.Fatalf("-use-local-api needs -local-api-key")
+	}
 
-}
+	var subnets []*net.IPNet
+	for _, cidr := range splitList(*flagAllowedSubnets) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("Bad -allowed-subnets: %s", err)
+		}
+		subnets = append(subnets, n)
+	}
 
-// Search performs an SDDP query via multicast.
-func Search(query string) ([]http.Header, error) {
-	conn, err := net.ListenUDP("udp", nil)
+	buckets, err := parseBuckets(*flagBuckets)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Bad -duration-buckets: %s", err)
 	}
-	defer conn.Close()
 
-	req := strings.Join([]string{
-		"M-SEARCH * HTTP/1.1",
-		"HOST: 239.255.255.250:1900",
-		"MAN: \"ssdp:discover\"",
-		"ST: " + query,
-		"MX: 1",
-	}, "\r\n")
+	stages := sonos.StageTimeouts{
+		Discovery: *flagDiscoveryTO,
+		Device:    *flagDeviceTO,
+		Ifconfig:  *flagIfconfigTO,
+		SOAP:      *flagSOAPTO,
+	}
+	// Only flags given explicitly are checked against -scrape-timeout: a
+	// shorter scrape timeout cuts the default -http-timeout short anyway.
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["timeout"] {
+		set["http-timeout"] = true
+	}
+	if *flagScrapeTimeout > 0 {
+		for name, d := range map[string]time.Duration{
+			"http-timeout":      *flagHTTPTimeout,
+			"discovery-timeout": stages.Discovery,
+			"device-timeout":    stages.Device,
+			"ifconfig-timeout":  stages.Ifconfig,
+			"soap-timeout":      stages.SOAP,
+		} {
+			if set[name] && d > *flagScrapeTimeout {
+				log.Fatalf("Bad -%s %s: longer than -scrape-timeout %s", name, d, *flagScrapeTimeout)
+			}
+		}
+	}
 
-	addr, err := net.ResolveUDPAddr("udp", "239.255.255.250:1900")
+	intervals, err := parseIntervals(*flagModelIntervals)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Bad -model-intervals: %s", err)
 	}
 
-	_, err = conn.WriteTo([]byte(req), addr)
-	if err != nil {
-		return nil, err
+	if !model.LabelName(*flagProbeLabel).IsValid() {
+		log.Fatalf("Bad -probe-target-label %q: not a label name", *flagProbeLabel)
 	}
 
-	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	// opts apply to both /metrics and /probe. discoveryOpts only concern
+	// finding and pacing the speakers behind /metrics; a probe collects
+	// just the target it's given.
+	opts := []sonos.Option{
+		sonos.WithTimeout(*flagHTTPTimeout),
+		sonos.WithInterfaceExcludes(splitList(*flagExcludeIfaces)...),
+		sonos.WithIfconfigRegexps(regexps),
+		sonos.WithScrapeTimeout(*flagScrapeTimeout),
+		sonos.WithAllowedSubnets(subnets...),
+		sonos.WithMaxResponseBytes(*flagMaxResponse),
+		sonos.WithActiveThreshold(*flagActiveThresh),
+		sonos.WithStageTimeouts(stages),
+	}
+	discoveryOpts := []sonos.Option{
+		sonos.WithDiscoveryCache(*flagDiscoveryTTL, *flagDiscoveryJit),
+		sonos.WithMaxConcurrency(*flagMaxConcurrency),
+		sonos.WithModelIntervals(intervals),
+		sonos.WithSSDPBackoff(*flagSSDPBackoff),
+		sonos.WithSSDPTTL(*flagSSDPTTL),
+	}
+	if !*flagRedirects {
+		opts = append(opts, sonos.WithHTTPClient(&http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}))
+	}
+	if *flagSourceIP != "" {
+		ip, err := parseSourceIP(*flagSourceIP)
+		switch {
+		case err == nil:
+			opts = append(opts, sonos.WithSourceIP(ip))
+		case *flagStrict:
+			log.Fatalf("Bad -source-ip: %s", err)
+		default:
+			log.Printf("Ignoring -source-ip: %s", err)
+		}
+	}
+	if udns := splitList(*flagUDNAllow); len(udns) > 0 {
+		opts = append(opts, sonos.WithUDNAllowlist(udns...))
+	}
+	if *flagSSDPAllowlist {
+		discoveryOpts = append(discoveryOpts, sonos.WithSSDPAllowlistRequired())
+	}
+	switch *flagDiscoveryMode {
+	case "auto":
+	case "both":
+		discoveryOpts = append(discoveryOpts, sonos.WithSSDPAndTargets())
+	default:
+		log.Fatalf("Bad -discovery-mode %q: must be auto or both", *flagDiscoveryMode)
+	}
+	if seeds := splitList(*flagSeeds); len(seeds) > 0 {
+		discoveryOpts = append(discoveryOpts, sonos.WithSeeds(seeds...))
+	}
+	if len(buckets) > 0 {
+		opts = append(opts, sonos.WithDurationBuckets(buckets))
+	}
+	if *flagResolve {
+		opts = append(opts, sonos.WithHostnames())
+	}
+	if *flagLabelTemplate != "" {
+		// Fields are looked up on execution, so try the template on an
+		// empty device to catch misspelled ones now.
+		t, err := template.New("target-label").Parse(*flagLabelTemplate)
+		if err == nil {
+			err = t.Execute(io.Discard, &sonos.Device{})
+		}
+		if err != nil {
+			log.Fatalf("Bad -target-label-template: %s", err)
+		}
+		opts = append(opts, sonos.WithTargetLabelTemplate(t))
+	}
+	if *flagRetryEmpty {
+		discoveryOpts = append(discoveryOpts, sonos.WithEmptyScrapeRetry())
+	}
+	if *flagDeltaMode {
+		discoveryOpts = append(discoveryOpts, sonos.WithDeltaMode())
+	}
+	if *flagStateFile != "" {
+		discoveryOpts = append(discoveryOpts, sonos.WithStateFile(*flagStateFile))
+	}
+	if *flagEventing {
+		// Only the main collector subscribes: /probe's collectors are
+		// made per request, and couldn't share the callback port.
+		l, err := net.Listen("tcp", *flagEventingAddr)
+		if err != nil {
+			log.Fatalf("Listening for events: %s", err)
+		}
+		discoveryOpts = append(discoveryOpts, sonos.WithEventing(l))
+	}
+	if *flagQuiet {
+		opts = append(opts, sonos.WithQuiet())
+	}
+	if *flagLocalAPI {
+		opts = append(opts, sonos.WithLocalAPI(*flagLocalAPIKey))
+	}
+	if *flagLenientXML {
+		opts = append(opts, sonos.WithLenientXML())
+	}
+	if *flagCollectAlarms {
+		opts = append(opts, sonos.WithAlarms())
+	}
+	if *flagTopology {
+		opts = append(opts, sonos.WithTopology())
+	}
 
-	var devices []http.Header
-	for {
-		buf := make([]byte, 65536)
+	reg := prometheus.DefaultRegisterer
+	if *flagFake > 0 {
+		discoveryOpts = append(discoveryOpts, sonos.WithFake(*flagFake))
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"fake": "true"}, reg)
+	}
 
-		n, _, err := conn.ReadFrom(buf)
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			break
-		} else if err != nil {
-			log.Printf("ReadFrom error: %s", err)
-			break
+	// Without -strict, NewCollector logs malformed targets and keeps what
+	// it can of them, and targets that don't resolve are reported down.
+	targets := splitList(*flagTargets)
+	if *flagStrict {
+		for _, spec := range targets {
+			if err := sonos.CheckTarget(context.Background(), spec); err != nil {
+				log.Fatalf("Bad -targets %q: %s", spec, err)
+			}
 		}
+	}
 
-		r := bufio.NewReader(bytes.NewReader(buf[:n]))
+	collector := sonos.NewCollector(targets, append(opts, discoveryOpts...)...)
 
-		resp, err := http.ReadResponse(r, &http.Request{})
+	if *flagRequireTargets || *flagStrict {
+		locs, err := collector.(sonos.Discoverer).Discover(context.Background())
 		if err != nil {
-			log.Printf("ReadResponse error: %s", err)
+			log.Fatalf("Discovering speakers: %s", err)
 		}
-		resp.Body.Close()
-
-		for _, head := range resp.Header["St"] {
-			if head == query {
-				devices = append(devices, resp.Header)
-				break
-			}
+		if len(locs) == 0 {
+			log.Fatalf("No speakers found; check -targets or that SSDP multicast reaches this host")
 		}
+		infof("Found %d speakers", len(locs))
 	}
 
-	return devices, nil
-}
+	reg.MustRegister(collector)
+
+	configMaxConcurrency.Set(float64(*flagMaxConcurrency))
+	configHTTPTimeout.Set(flagHTTPTimeout.Seconds())
+	prometheus.MustRegister(configMaxConcurrency, configHTTPTimeout, httpRequests)
+
+	infof("Sonos exporter listening on %s", *flagAddress)
+
+	// Use a fresh mux: importing net/http/pprof registers its handlers on
+	// http.DefaultServeMux, and they should only be served when asked for.
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentHandlerCounter(
+		httpRequests.MustCurryWith(prometheus.Labels{"path": "/metrics"}),
+		promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+				// Serve OpenMetrics to scrapers that ask for it.
+				EnableOpenMetrics: true,
+			}),
+		),
+	))
+
+	mux.Handle("/probe", promhttp.InstrumentHandlerCounter(
+		httpRequests.MustCurryWith(prometheus.Labels{"path": "/probe"}),
+		probeHandler(opts, *flagProbeLabel, *flagScrapeTimeout),
+	))
+
+	if *flagEnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		mux.Handle("/-/refresh-discovery", refreshHandler(collector.(sonos.Refresher)))
+	}
 
-func collect(ch chan<- prometheus.Metric, loc string) {
-	base, err := url.Parse(loc)
-	if err != nil {
-		log.Printf("Parse %s: %s", loc, err)
-		collectionErrors.Inc()
-		return
+	server := &http.Server{Addr: *flagAddress, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Let in-flight scrapes finish on SIGTERM, as sent by systemd and
+	// Kubernetes, rather than cutting them off.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	infof("Got %s, shutting down", <-sigs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %s", err)
 	}
+}
 
-	d, err := fetchDevice(base)
-	if err != nil {
-		log.Printf("Get info %s: %s", loc, err)
-		collectionErrors.Inc()
-		return
-	}
-
-	ch <- prometheus.MustNewConstMetric(
-		speakerInfo,
-		prometheus.GaugeValue,
-		1,
-		d.RoomName,
-		d.DisplayVersion,
-		d.HardwareVersion,
-		d.ModelName,
-		d.ModelNumber,
-		d.SerialNum,
-		d.SoftwareVersion,
-		d.UDN,
-	)
+// shutdownTimeout is how long in-flight requests get to finish on
+// shutdown.
+const shutdownTimeout = 30 * time.Second
 
-	ifaces, err := fetchIfconfig(base)
-	if err != nil {
-		log.Printf("Get ifconfig %s: %s", loc, err)
-		collectionErrors.Inc()
-		return
-	}
-
-	for device, stats := range ifaces {
-		ch <- prometheus.MustNewConstMetric(
-			rxBytes,
-			prometheus.GaugeValue,
-			stats.rxBytes,
-			d.RoomName,
-			device,
-		)
-
-		ch <- prometheus.MustNewConstMetric(
-			rxPackets,
-			prometheus.GaugeValue,
-			stats.rxPackets,
-			d.RoomName,
-			device,
-		)
-
-		ch <- prometheus.MustNewConstMetric(
-			txBytes,
-			prometheus.GaugeValue,
-			stats.txBytes,
-			d.RoomName,
-			device,
-		)
-
-		ch <- prometheus.MustNewConstMetric(
-			txPackets,
-			prometheus.GaugeValue,
-			stats.txPackets,
-			d.RoomName,
-			device,
-		)
+// infof logs a routine message, unless -quiet is set.
+func infof(format string, args ...interface{}) {
+	if !*flagQuiet {
+		log.Printf(format, args...)
 	}
 }
 
-func fetchDevice(u *url.URL) (*Device, error) {
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// refreshHandler makes r discover speakers again on POST, reporting how
+// many it found.
+func refreshHandler(r sonos.Refresher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
 
-	var root struct {
-		Device Device `xml:"device"`
-	}
-	if err = xml.NewDecoder(resp.Body).Decode(&root); err != nil {
-		log.Printf("Decode %s: %s", u.String(), err)
-	}
+		locs, err := r.Refresh(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	return &root.Device, err
+		infof("Refreshed discovery: %d speakers", len(locs))
+		fmt.Fprintf(w, "%d\n", len(locs))
+	})
 }
 
-type Device struct {
-	DeviceType      string `xml:"deviceType"`
-	RoomName        string `xml:"roomName"`
-	DisplayVersion  string `xml:"displayVersion"`
-	HardwareVersion string `xml:"hardwareVersion"`
-	ModelName       string `xml:"modelName"`
-	ModelNumber     string `xml:"modelNumber"`
-	SerialNum       string `xml:"serialNum"`
-	SoftwareVersion string `xml:"softwareVersion"`
-	UDN             string `xml:"UDN"`
+// probeHandler serves the metrics of the single speaker named by the
+// target parameter, for Prometheus's multi-target exporter pattern. Each
+// metric is labeled with the target under label, so it can be
+// relabeled to instance even on metrics that don't otherwise name it.
+// Like blackbox_exporter, it finishes within the scrape timeout
+// Prometheus sends, less a margin for the response, if that's shorter
+// than timeout.
+func probeHandler(opts []sonos.Option, label string, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		probeOpts := opts
+		if d := scrapeTimeout(r) - probeTimeoutMargin; d > 0 && (timeout == 0 || d < timeout) {
+			probeOpts = append(opts[:len(opts):len(opts)], sonos.WithScrapeTimeout(d))
+		}
+
+		reg := prometheus.NewRegistry()
+		wrapped := prometheus.WrapRegistererWith(prometheus.Labels{label: target}, reg)
+		collector := sonos.NewCollector([]string{target}, probeOpts...)
+		if err := wrapped.Register(collector); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+
+		// Each probe has a collector, and so a transport, of its own,
+		// whose connections would otherwise sit idle until they time out.
+		collector.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+	})
 }
 
-func fetchIfconfig(base *url.URL) (map[string]stats, error) {
-	u := *base
-	u.Path = "/status/ifconfig"
+// probeTimeoutMargin is taken off Prometheus's scrape timeout to leave
+// time to send the probe's response.
+const probeTimeoutMargin = 500 * time.Millisecond
 
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return nil, err
+// scrapeTimeout returns the scrape timeout Prometheus sends with each
+// scrape, or 0 if r doesn't have one.
+func scrapeTimeout(r *http.Request) time.Duration {
+	s, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || s <= 0 {
+		return 0
 	}
-	defer resp.Body.Close()
+	return time.Duration(s * float64(time.Second))
+}
 
-	var root struct {
-		Command string `xml:"Command"`
+// parseSourceIP parses s as the -source-ip address, which must be one of
+// this host's.
+func parseSourceIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
 	}
-	if err = xml.NewDecoder(resp.Body).Decode(&root); err != nil {
-		log.Printf("Decode %s: %s", u.String(), err)
+	if !isLocalIP(ip) {
+		return nil, fmt.Errorf("%s is not an address of this host", ip)
 	}
+	return ip, nil
+}
 
-	// root.Command is a blank line separated series of network interfaces:
-	//
-	// lo        Link encap:Local Loopback
-	//           inet addr:127.0.0.1  Mask:255.0.0.0
-	//           UP LOOPBACK RUNNING  MTU:16436  Metric:1
-	//           RX packets:1558 errors:0 dropped:0 overruns:0 frame:0
-	//           TX packets:1558 errors:0 dropped:0 overruns:0 carrier:0
-	//           collisions:0 txqueuelen:0
-	//           RX bytes:263284 (257.1 KiB)  TX bytes:263284 (257.1
+// isLocalIP reports whether ip is assigned to one of this host's
+// interfaces.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
 
-	ret := make(map[string]stats)
+// listFlag collects the values of a flag given more than once.
+type listFlag []string
 
-	for _, text := range strings.Split(root.Command, "\n\n") {
-		if strings.TrimSpace(text) == "" {
-			continue
-		}
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
 
-		var m []string
-		var s stats
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
 
-		m = rxBytesRe.FindStringSubmatch(text)
-		if len(m) > 1 {
-			s.rxBytes = atof(m[1])
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
 		}
+	}
+	return ret
+}
 
-		m = rxPacketsRe.FindStringSubmatch(text)
-		if len(m) > 1 {
-			s.rxPackets = atof(m[1])
-		}
+// parseIntervals parses a comma separated list of model=interval pairs,
+// where model is a Sonos model number (e.g. S17 for the Move) and
+// interval is how long a speaker of that model's metrics are reused for.
+func parseIntervals(spec string) (map[string]time.Duration, error) {
+	ret := make(map[string]time.Duration)
 
-		m = txBytesRe.FindStringSubmatch(text)
-		if len(m) > 1 {
-			s.txBytes = atof(m[1])
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
 		}
 
-		m = txPacketsRe.FindStringSubmatch(text)
-		if len(m) > 1 {
-			s.txPackets = atof(m[1])
+		model, interval, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not model=interval", pair)
 		}
 
-		name := ifaceNameRe.FindString(text)
-		if name != "" {
-			ret[name] = s
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%q: interval must be a positive duration", pair)
 		}
+
+		ret[strings.TrimSpace(model)] = d
 	}
 
-	return ret, err
+	return ret, nil
 }
 
-func atof(num string) float64 {
-	v, err := strconv.ParseFloat(num, 64)
-	if err != nil {
-		return 0
+// parseBuckets parses a comma separated list of histogram buckets, which
+// must be positive and increasing.
+func parseBuckets(spec string) ([]float64, error) {
+	var ret []float64
+
+	for _, v := range splitList(spec) {
+		b, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		if b <= 0 {
+			return nil, fmt.Errorf("%v is not positive", b)
+		}
+		if len(ret) > 0 && b <= ret[len(ret)-1] {
+			return nil, fmt.Errorf("%v is not greater than %v", b, ret[len(ret)-1])
+		}
+		ret = append(ret, b)
 	}
-	return v
-}
 
-type stats struct {
-	rxBytes   float64
-	rxPackets float64
-	txBytes   float64
-	txPackets float64
+	return ret, nil
 }
-
-var (
-	ifaceNameRe = regexp.MustCompile(`^[^ ]+`)
-	rxBytesRe   = regexp.MustCompile(`RX bytes:(\d+)`)
-	rxPacketsRe = regexp.MustCompile(`RX packets:(\d+)`)
-	txBytesRe   = regexp.MustCompile(`TX bytes:(\d+)`)
-	txPacketsRe = regexp.MustCompile(`TX packets:(\d+)`)
-)
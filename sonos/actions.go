@@ -0,0 +1,110 @@
+package sonos
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var supportedActions = prometheus.NewDesc(
+	"sonos_supported_actions", "SOAP actions the speaker's service declares in its service description",
+	[]string{"player", "serial_num", "service"},
+	nil,
+)
+
+// fetchActions returns how many actions the service description at
+// scpdURL, relative to base, declares. Like control URLs, scpdURL is
+// only followed on the speaker at base.
+func (f *httpFetcher) fetchActions(ctx context.Context, base *url.URL, scpdURL string) (int, error) {
+	u, err := speakerURL(base, scpdURL)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := f.requestContext(ctx, u, f.stages.Device)
+	defer cancel()
+
+	resp, err := f.get(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+
+	var scpd struct {
+		Actions []struct {
+			Name string `xml:"name"`
+		} `xml:"actionList>action"`
+	}
+	if err := f.newDecoder(resp.Body).Decode(&scpd); err != nil {
+		return 0, err
+	}
+
+	return len(scpd.Actions), nil
+}
+
+// allServices returns the services of d and its embedded devices.
+func (d *Device) allServices() []Service {
+	ret := append([]Service(nil), d.Services...)
+	for i := range d.Devices {
+		ret = append(ret, d.Devices[i].allServices()...)
+	}
+	return ret
+}
+
+// serviceName names s for sonos_supported_actions by its control URL,
+// which unlike its type is unique within a device: both MediaRenderer
+// and MediaServer have a ConnectionManager, for example.
+func serviceName(s Service) string {
+	return strings.TrimSuffix(strings.TrimPrefix(s.ControlURL, "/"), "/Control")
+}
+
+// collectActions emits how many actions each of the speaker's services
+// declares. A service's description only changes with firmware, so each
+// count is kept until the speaker's software version does.
+func (c *collector) collectActions(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device) {
+	seen := make(map[string]bool)
+
+	for _, s := range d.allServices() {
+		name := serviceName(s)
+		if s.SCPDURL == "" || name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		key := [3]string{base.Host, d.SoftwareVersion, s.SCPDURL}
+
+		c.actionsMu.Lock()
+		n, ok := c.actions[key]
+		c.actionsMu.Unlock()
+
+		if !ok {
+			var err error
+			n, err = c.fetcher.fetchActions(ctx, base, s.SCPDURL)
+			if err != nil {
+				log.Printf("Get service description %s%s: %s", base, s.SCPDURL, err)
+				c.fail(base.Host, "actions", err)
+				continue
+			}
+
+			c.actionsMu.Lock()
+			c.actions[key] = n
+			c.actionsMu.Unlock()
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			supportedActions,
+			prometheus.GaugeValue,
+			float64(n),
+			d.RoomName,
+			d.SerialNum,
+			name,
+		)
+	}
+}
@@ -0,0 +1,38 @@
+package sonos
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFetchActions_OtherHost(t *testing.T) {
+	var elsewhere atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhere.Add(1)
+	}))
+	defer other.Close()
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/RenderingControl1.xml": serve(`<scpd xmlns="urn:schemas-upnp-org:service-1-0"><actionList>` +
+			`<action><name>GetVolume</name></action><action><name>GetMute</name></action>` +
+			`</actionList></scpd>`),
+	})
+
+	// An SCPDURL pointing at another host only gets the speaker itself
+	// asked.
+	f := NewCollector(nil).(*collector).fetcher.(*httpFetcher)
+	n, err := f.fetchActions(context.Background(), &url.URL{Scheme: "http", Host: target}, other.URL+"/xml/RenderingControl1.xml")
+	if err != nil {
+		t.Fatalf("fetchActions: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("fetchActions = %d, want 2", n)
+	}
+	if n := elsewhere.Load(); n != 0 {
+		t.Errorf("the other host got %d requests, want 0", n)
+	}
+}
@@ -0,0 +1,120 @@
+package sonos
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	alarmCount = prometheus.NewDesc(
+		"sonos_alarm_count", "Number of alarms configured in the household",
+		[]string{"household"},
+		nil,
+	)
+
+	alarmEnabled = prometheus.NewDesc(
+		"sonos_alarm_enabled", "Whether the alarm is enabled",
+		[]string{"household", "id", "room_name", "start_time", "recurrence"},
+		nil,
+	)
+)
+
+// Alarm is one entry from the AlarmClock service's alarm list.
+type Alarm struct {
+	ID         string `xml:"ID,attr"`
+	StartTime  string `xml:"StartTime,attr"`
+	Recurrence string `xml:"Recurrence,attr"`
+	Enabled    string `xml:"Enabled,attr"`
+	RoomUUID   string `xml:"RoomUUID,attr"`
+}
+
+// fetchHouseholdID returns the ID of the household the speaker at base
+// belongs to.
+func (f *httpFetcher) fetchHouseholdID(ctx context.Context, base *url.URL, d *Device) (string, error) {
+	var resp struct {
+		CurrentHouseholdID string `xml:"CurrentHouseholdID"`
+	}
+	err := f.soapCall(ctx, base, d, devicePropertiesService, "GetHouseholdID", nil, &resp)
+	return resp.CurrentHouseholdID, err
+}
+
+// fetchAlarms lists the alarms known to the speaker at base. Alarms are
+// shared by the whole household, so any one of its speakers will do.
+func (f *httpFetcher) fetchAlarms(ctx context.Context, base *url.URL, d *Device) ([]Alarm, error) {
+	var resp struct {
+		CurrentAlarmList string `xml:"CurrentAlarmList"`
+	}
+	err := f.soapCall(ctx, base, d, alarmClockService, "ListAlarms", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The alarm list is itself an XML document, escaped into the
+	// CurrentAlarmList string.
+	var list struct {
+		Alarms []Alarm `xml:"Alarm"`
+	}
+	if err := f.unmarshal(resp.CurrentAlarmList, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Alarms, nil
+}
+
+// collectAlarms emits the alarms of each household among devices, a map
+// of location to device, querying one speaker per household.
+func (c *collector) collectAlarms(ctx context.Context, ch chan<- prometheus.Metric, devices map[string]*Device) {
+	households := make(map[string]string)
+	rooms := make(map[string]string)
+
+	for loc, d := range devices {
+		rooms[strings.TrimPrefix(d.UDN, "uuid:")] = d.RoomName
+
+		if d.HouseholdID != "" {
+			households[d.HouseholdID] = loc
+		}
+	}
+
+	for household, loc := range households {
+		base, err := url.Parse(loc)
+		if err != nil {
+			continue
+		}
+
+		alarms, err := c.fetcher.fetchAlarms(ctx, base, devices[loc])
+		if err != nil {
+			log.Printf("List alarms %s: %s", loc, err)
+			c.fail(base.Host, "alarms", err)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			alarmCount,
+			prometheus.GaugeValue,
+			float64(len(alarms)),
+			household,
+		)
+
+		for _, a := range alarms {
+			var enabled float64
+			if a.Enabled == "1" {
+				enabled = 1
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				alarmEnabled,
+				prometheus.GaugeValue,
+				enabled,
+				household,
+				a.ID,
+				rooms[a.RoomUUID],
+				a.StartTime,
+				a.Recurrence,
+			)
+		}
+	}
+}
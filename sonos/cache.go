@@ -0,0 +1,70 @@
+package sonos
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// targetCache holds the metrics from each target's last fetch so that
+// speakers with a model interval can skip fetches between them.
+type targetCache struct {
+	intervals map[string]time.Duration
+
+	mu      sync.Mutex
+	targets map[string]*cachedTarget
+}
+
+type cachedTarget struct {
+	device   *Device
+	fetched  time.Time
+	interval time.Duration
+	metrics  []prometheus.Metric
+}
+
+func newTargetCache(intervals map[string]time.Duration) *targetCache {
+	return &targetCache{
+		intervals: intervals,
+		targets:   make(map[string]*cachedTarget),
+	}
+}
+
+// get returns the cached target for loc if its interval hasn't passed
+// since it was fetched. Going by time rather than by counting scrapes
+// keeps the interval the same however often Prometheus scrapes, and
+// whether or not several scrape configs share the exporter.
+func (c *targetCache) get(loc string) (*cachedTarget, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.targets[loc]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Since(t.fetched) >= t.interval {
+		delete(c.targets, loc)
+		return nil, false
+	}
+
+	return t, true
+}
+
+// put records the metrics fetched from loc, if its model has an interval.
+func (c *targetCache) put(loc string, d *Device, metrics []prometheus.Metric) {
+	interval := c.intervals[d.ModelNumber]
+	if interval <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.targets[loc] = &cachedTarget{
+		device:   d,
+		fetched:  time.Now(),
+		interval: interval,
+		metrics:  metrics,
+	}
+}
@@ -0,0 +1,33 @@
+package sonos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTargetCache(t *testing.T) {
+	c := newTargetCache(map[string]time.Duration{"S17": time.Minute})
+
+	move := &Device{RoomName: "Patio", ModelNumber: "S17"}
+	one := &Device{RoomName: "Kitchen", ModelNumber: "S18"}
+
+	c.put("move", move, nil)
+	c.put("one", one, nil)
+
+	if _, ok := c.get("one"); ok {
+		t.Errorf("got a cached S18, which has no interval")
+	}
+
+	// However many scrapes come within the interval, they're all served
+	// from the cache.
+	for i := 0; i < 5; i++ {
+		if got, ok := c.get("move"); !ok || got.device != move {
+			t.Fatalf("scrape %d: got %v, %v; want the cached S17", i, got, ok)
+		}
+	}
+
+	c.targets["move"].fetched = time.Now().Add(-time.Minute)
+	if _, ok := c.get("move"); ok {
+		t.Errorf("got the S17 from the cache after its interval")
+	}
+}
@@ -0,0 +1,32 @@
+package sonos
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// fetchTime returns how far the speaker's UTC clock is ahead of ours,
+// according to the AlarmClock service's GetTimeNow action.
+func (f *httpFetcher) fetchTime(ctx context.Context, base *url.URL, d *Device) (time.Duration, error) {
+	var resp struct {
+		CurrentUTCTime string `xml:"CurrentUTCTime"`
+	}
+
+	start := time.Now()
+	err := f.soapCall(ctx, base, d, alarmClockService, "GetTimeNow", nil, &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	// The response only has second resolution, so compare it against
+	// the middle of the round trip.
+	now := start.Add(time.Since(start) / 2)
+
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", resp.CurrentUTCTime, time.UTC)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Sub(now), nil
+}
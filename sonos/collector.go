@@ -0,0 +1,1957 @@
+// Package sonos implements a Prometheus collector for the speakers in a
+// Sonos network.
+package sonos
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	collectionDuration = prometheus.NewDesc(
+		"sonos_collection_duration",
+		"Total collection time",
+		nil,
+		nil,
+	)
+
+	roomCount = prometheus.NewDesc(
+		"sonos_room_count", "Distinct room names among collected speakers",
+		nil,
+		nil,
+	)
+
+	speakerCount = prometheus.NewDesc(
+		"sonos_speaker_count", "Distinct serial numbers among collected speakers",
+		nil,
+		nil,
+	)
+
+	distinctUDNs = prometheus.NewDesc(
+		"sonos_distinct_udns", "Distinct UDNs among collected speakers",
+		nil,
+		nil,
+	)
+
+	distinctSerials = prometheus.NewDesc(
+		"sonos_distinct_serials", "Distinct serial numbers among collected speakers, which should match sonos_distinct_udns",
+		nil,
+		nil,
+	)
+
+	devicesByModel = prometheus.NewDesc(
+		"sonos_devices_by_model", "Distinct serial numbers among collected speakers of each model",
+		[]string{"model_name"},
+		nil,
+	)
+
+	discoveryModeDesc = prometheus.NewDesc(
+		"sonos_discovery_mode", "Whether speakers are found with this discovery mode",
+		[]string{"mode"},
+		nil,
+	)
+
+	discoveryCacheAge = prometheus.NewDesc(
+		"sonos_discovery_cache_age_seconds", "Time since the cached discovery results were refreshed",
+		nil,
+		nil,
+	)
+
+	discoveryCacheHit = prometheus.NewDesc(
+		"sonos_discovery_cache_hit", "Whether this scrape reused cached discovery results (1) or discovered afresh (0)",
+		nil,
+		nil,
+	)
+
+	connectLatency = prometheus.NewDesc(
+		"sonos_target_connect_latency_seconds", "TCP connect time for the target's device description fetch, when a new connection was made",
+		[]string{"target"},
+		nil,
+	)
+
+	up = prometheus.NewDesc(
+		"sonos_up", "Whether the target was collected successfully",
+		[]string{"target"},
+		nil,
+	)
+
+	discoveredUnreachable = prometheus.NewDesc(
+		"sonos_discovered_but_unreachable", "Whether the target was discovered but its device description couldn't be fetched",
+		[]string{"target"},
+		nil,
+	)
+
+	speakerCached = prometheus.NewDesc(
+		"sonos_speaker_cached", "Whether the speaker's metrics were served from cache",
+		[]string{"player", "serial_num"},
+		nil,
+	)
+
+	speakerInfo = prometheus.NewDesc(
+		"sonos_speaker", "Sonos speaker info",
+		[]string{
+			"room_name",
+			"display_version",
+			"hardware_version",
+			"model_name",
+			"model_number",
+			"serial_num",
+			"mac_serial",
+			"software_version",
+			"udn",
+			"ip",
+			"hostname",
+			"target_label",
+		},
+		nil,
+	)
+
+	deviceVisible = prometheus.NewDesc(
+		"sonos_device_visible", "Whether the device is a user facing zone rather than infrastructure like a Boost, Bridge or bonded satellite",
+		[]string{"player", "udn"},
+		nil,
+	)
+
+	firmwareGeneration = prometheus.NewDesc(
+		"sonos_firmware_generation_info", "Sonos software generation the speaker runs: S1, S2 or unknown",
+		[]string{"player", "udn", "generation"},
+		nil,
+	)
+
+	roomNameNonASCII = prometheus.NewDesc(
+		"sonos_room_name_has_nonascii", "Whether the room name has non-ASCII characters, like emoji, that may trip up other tools",
+		[]string{"player", "serial_num"},
+		nil,
+	)
+
+	clockSkew = prometheus.NewDesc(
+		"sonos_clock_skew_seconds", "Speaker clock minus exporter clock",
+		[]string{"player", "serial_num"},
+		nil,
+	)
+
+	rxBytes = prometheus.NewDesc(
+		"sonos_rx_bytes", "Received bytes",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	txBytes = prometheus.NewDesc(
+		"sonos_tx_bytes", "Transmitted bytes",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	rxPackets = prometheus.NewDesc(
+		"sonos_rx_packets", "Received packets",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	txPackets = prometheus.NewDesc(
+		"sonos_tx_packets", "Transmitted packets ",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	rxAvgPacketBytes = prometheus.NewDesc(
+		"sonos_rx_avg_packet_bytes", "Received bytes per received packet, 0 before any packets",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	txAvgPacketBytes = prometheus.NewDesc(
+		"sonos_tx_avg_packet_bytes", "Transmitted bytes per transmitted packet, 0 before any packets",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	collisions = prometheus.NewDesc(
+		"sonos_collisions_total", "Transmit collisions",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	txQueueLen = prometheus.NewDesc(
+		"sonos_tx_queue_len", "Transmit queue length",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	interfaceSpeed = prometheus.NewDesc(
+		"sonos_interface_speed_bps", "Link speed in bits per second, where the firmware reports it",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	interfaceMTU = prometheus.NewDesc(
+		"sonos_interface_mtu", "The interface's MTU in bytes",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	rxBacklog = prometheus.NewDesc(
+		"sonos_rx_backlog", "Received packets waiting to be processed, where the firmware reports it",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	txBacklog = prometheus.NewDesc(
+		"sonos_tx_backlog", "Packets queued for transmit, where the firmware reports it",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	interfaceUp = prometheus.NewDesc(
+		"sonos_interface_up", "Whether the interface is flagged UP and RUNNING",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	interfaceAddress = prometheus.NewDesc(
+		"sonos_interface_address_info", "Interface addresses, empty when the interface has none of that family",
+		[]string{"player", "serial_num", "device", "ipv4", "ipv6"},
+		nil,
+	)
+
+	interfaceFieldsParsed = prometheus.NewDesc(
+		"sonos_interface_fields_parsed", "Number of the interface's stats found in the ifconfig output",
+		[]string{"player", "serial_num", "device"},
+		nil,
+	)
+
+	active = prometheus.NewDesc(
+		"sonos_active", "Whether the player moved more network traffic since the previous scrape than an idle speaker does, a heuristic for it being in use",
+		[]string{"player", "serial_num"},
+		nil,
+	)
+
+	interfacesDown = prometheus.NewDesc(
+		"sonos_interfaces_down", "Number of interfaces not flagged UP and RUNNING",
+		[]string{"player", "serial_num"},
+		nil,
+	)
+)
+
+// A CollectError is an error collecting a speaker, passed to the
+// WithErrorHandler function.
+type CollectError struct {
+	// Target is the host[:port] of the speaker, or empty for errors not
+	// tied to one, like failing to discover speakers at all.
+	Target string
+
+	// Stage is what was being done: "search", "parse", "device",
+	// "ifconfig", "actions", "time", "line_in", "rendering", "transport",
+	// "events", "household", "alarms" or "topology".
+	Stage string
+
+	Err error
+}
+
+func (e CollectError) Error() string {
+	if e.Target == "" {
+		return fmt.Sprintf("%s: %s", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Stage, e.Target, e.Err)
+}
+
+func (e CollectError) Unwrap() error {
+	return e.Err
+}
+
+// fail counts an error at stage of collecting target and passes it to
+// the WithErrorHandler function, if any.
+func (c *collector) fail(target, stage string, err error) {
+	c.errors.WithLabelValues(target, stage).Inc()
+	if c.onError != nil {
+		c.onError(CollectError{Target: target, Stage: stage, Err: err})
+	}
+}
+
+// errNotAllowed is returned by collectDevice for a speaker that isn't in
+// the UDN allowlist, which is skipped rather than reported as down.
+var errNotAllowed = errors.New("UDN not allowed")
+
+type collector struct {
+	discoverer  Discoverer
+	cacheTTL    time.Duration
+	cacheJitter float64
+	fetcher     fetcher
+	client      *http.Client
+	transport   *http.Transport
+	sourceIP    net.IP
+	httpTimeout time.Duration
+	timeouts    map[string]time.Duration
+	excludes    map[string]bool
+	regexps     map[string]*regexp.Regexp
+	cache       *targetCache
+	timeout     time.Duration
+	sem         chan struct{}
+	alarms      bool
+	topology    bool
+	udnAllow    map[string]bool
+	ssdpAllow   bool
+	subnets     []*net.IPNet
+	ssdpBackoff time.Duration
+	ssdpTTL     int
+	alsoSSDP    bool
+	lenientXML  bool
+	maxResponse int64
+	buckets     []float64
+	seeds       []string
+	resolver    *hostResolver
+	resolve     bool
+	onError     func(CollectError)
+	stages      StageTimeouts
+	localAPI    bool
+	localAPIKey string
+	retryEmpty  bool
+	delta       *deltaFilter
+	events      *eventSubscriber
+	quiet       bool
+
+	// labelTemplate, if set, makes sonos_speaker's target_label.
+	labelTemplate *template.Template
+
+	// namedTargets is set when a target or seed is a host name rather
+	// than an address.
+	namedTargets bool
+
+	errors               *prometheus.CounterVec
+	parseDuration        prometheus.Histogram
+	ssdpMaxResponseBytes prometheus.GaugeFunc
+	ssdpLocations        prometheus.Gauge
+	goroutines           prometheus.Gauge
+	scrapeDuration       prometheus.Histogram
+	counterResets        *prometheus.CounterVec
+	parserInfo           prometheus.Gauge
+	emptyRetries         prometheus.Counter
+	filtered             *prometheus.CounterVec
+	ssdpLatency          *prometheus.HistogramVec
+	soapErrors           *prometheus.CounterVec
+	overlaps             prometheus.Counter
+	dnsLookups           *prometheus.CounterVec
+	dnsErrors            *prometheus.CounterVec
+
+	// inFlight is the number of Collects running.
+	inFlight atomic.Int32
+
+	// lastBytes holds each interface's previous rx and tx bytes, keyed
+	// by target host and interface, for spotting counter resets. resets
+	// mirrors counterResets, keyed by player and interface, for saving
+	// to stateFile.
+	lastMu     sync.Mutex
+	lastBytes  map[[2]string][2]float64
+	resets     map[[2]string]float64
+	stateFile  string
+	stateSaved time.Time
+
+	// lastIfconfig is when each target host's ifconfig was last fetched,
+	// for turning the bytes moved since into a rate for sonos_active.
+	lastIfconfig    map[string]time.Time
+	activeThreshold float64
+
+	// actions caches sonos_supported_actions, keyed by target host,
+	// software version and service description URL.
+	actionsMu sync.Mutex
+	actions   map[[3]string]int
+}
+
+// An Option configures the collector returned by NewCollector.
+type Option func(*collector)
+
+// WithHTTPClient makes the collector use client for requests to the
+// speakers. The default is a client of the collector's own. A client
+// with no Transport is given the collector's, rather than sharing
+// http.DefaultTransport with the rest of the program.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *collector) {
+		c.client = client
+	}
+}
+
+// WithSourceIP makes the collector's connections to the speakers from ip,
+// which must be one of this host's addresses.
+func WithSourceIP(ip net.IP) Option {
+	return func(c *collector) {
+		c.sourceIP = ip
+	}
+}
+
+// WithTimeout bounds each request to a speaker by d. The default is no
+// timeout beyond the HTTP client's own.
+func WithTimeout(d time.Duration) Option {
+	return func(c *collector) {
+		c.httpTimeout = d
+	}
+}
+
+// WithInterfaceExcludes skips the named network interfaces (e.g. "lo")
+// when exporting ifconfig stats.
+func WithInterfaceExcludes(names ...string) Option {
+	return func(c *collector) {
+		for _, name := range names {
+			c.excludes[name] = true
+		}
+	}
+}
+
+// WithIfconfigRegexps overrides the regexps that find each stat in the
+// ifconfig output, for firmware with translated labels. Build regexps
+// with CompileIfconfigRegexps; fields without one keep the English
+// default.
+func WithIfconfigRegexps(regexps map[string]*regexp.Regexp) Option {
+	return func(c *collector) {
+		for field, re := range regexps {
+			c.regexps[field] = re
+		}
+	}
+}
+
+// WithDiscoverer replaces how speakers are found, overriding both SSDP
+// and the targets passed to NewCollector.
+func WithDiscoverer(d Discoverer) Option {
+	return func(c *collector) {
+		c.discoverer = d
+	}
+}
+
+// WithFake replaces discovery and every fetch with n synthetic speakers
+// whose counters follow a random walk, for building dashboards without
+// any Sonos gear.
+func WithFake(n int) Option {
+	return func(c *collector) {
+		f := newFakeFetcher(n)
+		c.discoverer = f
+		c.fetcher = f
+	}
+}
+
+// WithDiscoveryCache reuses discovered speakers for ttl instead of
+// discovering them on every scrape. Each refresh's TTL is scaled by a
+// random factor within jitter (e.g. 0.1 for ±10%), so that several
+// exporters don't all rediscover at once.
+func WithDiscoveryCache(ttl time.Duration, jitter float64) Option {
+	return func(c *collector) {
+		c.cacheTTL = ttl
+		c.cacheJitter = jitter
+	}
+}
+
+// WithScrapeTimeout bounds each whole scrape by d. When the deadline
+// passes, in-flight fetches are canceled and their targets report
+// sonos_up 0, leaving whatever was already collected.
+func WithScrapeTimeout(d time.Duration) Option {
+	return func(c *collector) {
+		c.timeout = d
+	}
+}
+
+// WithModelIntervals makes speakers whose model number is a key of
+// intervals be fetched at most once per interval, serving their last
+// metrics to the scrapes in between.
+func WithModelIntervals(intervals map[string]time.Duration) Option {
+	return func(c *collector) {
+		c.cache = newTargetCache(intervals)
+	}
+}
+
+// WithMaxConcurrency limits how many speakers are collected at once,
+// across overlapping scrapes. The default, 0, is no limit.
+func WithMaxConcurrency(n int) Option {
+	return func(c *collector) {
+		c.sem = nil
+		if n > 0 {
+			c.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithAlarms enables collecting each household's alarms.
+func WithAlarms() Option {
+	return func(c *collector) {
+		c.alarms = true
+	}
+}
+
+// WithTopology enables collecting each household's groups, which also
+// labels the playback metrics with the room of each speaker's group
+// coordinator.
+func WithTopology() Option {
+	return func(c *collector) {
+		c.topology = true
+	}
+}
+
+// WithUDNAllowlist only exports speakers whose UDN (e.g.
+// "uuid:RINCON_000E58123456701400", with or without the "uuid:" prefix)
+// is in udns. Other speakers' descriptions are still fetched to learn
+// their UDN; see WithSSDPAllowlistRequired to avoid that.
+func WithUDNAllowlist(udns ...string) Option {
+	return func(c *collector) {
+		c.udnAllow = make(map[string]bool)
+		for _, udn := range udns {
+			c.udnAllow[normalizeUDN(udn)] = true
+		}
+	}
+}
+
+// WithSSDPAllowlistRequired drops SSDP responses whose USN isn't for a
+// UDN in the WithUDNAllowlist allowlist, so the exporter never requests
+// a Location advertised by an unknown device. With no allowlist, every
+// response is dropped.
+func WithSSDPAllowlistRequired() Option {
+	return func(c *collector) {
+		c.ssdpAllow = true
+	}
+}
+
+// WithAllowedSubnets only connects to addresses within subnets, so a
+// crafted SSDP Location or a redirect can't point the exporter at an
+// arbitrary host. Targets outside them are logged and skipped. It's
+// enforced by the collector's transport, so a client given to
+// WithHTTPClient with a Transport of its own isn't restricted.
+func WithAllowedSubnets(subnets ...*net.IPNet) Option {
+	return func(c *collector) {
+		c.subnets = subnets
+	}
+}
+
+// WithSSDPBackoff sets how long an SSDP search first waits after a
+// transient read error before reading on. Each further error in a row
+// doubles the wait, and every wait is jittered by ±50%.
+func WithSSDPBackoff(d time.Duration) Option {
+	return func(c *collector) {
+		c.ssdpBackoff = d
+	}
+}
+
+// WithSSDPTTL sets the multicast TTL of SSDP searches, the number of
+// routers they may cross. The default, the OS's (normally 1), keeps them
+// on the local segment.
+func WithSSDPTTL(ttl int) Option {
+	return func(c *collector) {
+		c.ssdpTTL = ttl
+	}
+}
+
+// WithSSDPAndTargets discovers speakers via SSDP in addition to the
+// targets passed to NewCollector, instead of the targets replacing SSDP.
+// A speaker found both ways is collected once.
+func WithSSDPAndTargets() Option {
+	return func(c *collector) {
+		c.alsoSSDP = true
+	}
+}
+
+// WithLenientXML decodes speakers' responses in encoding/xml's
+// non-strict mode, which tolerates undeclared entities and unclosed
+// elements instead of failing the whole fetch.
+func WithLenientXML() Option {
+	return func(c *collector) {
+		c.lenientXML = true
+	}
+}
+
+// WithStateFile keeps the byte counts last seen on each interface and
+// the counts of sonos_counter_resets_total in the file at path, so a
+// speaker that reboots while the exporter is restarting is still caught
+// and the reset counts carry on. The file is loaded by NewCollector and
+// saved at most once a minute, at the end of a scrape.
+func WithStateFile(path string) Option {
+	return func(c *collector) {
+		c.stateFile = path
+	}
+}
+
+// DefaultActiveThreshold is the default traffic, in bytes per second,
+// above which a player counts as active: about a low bitrate stream.
+// Idle speakers chatter at a few hundred bytes per second.
+const DefaultActiveThreshold = 16 << 10
+
+// WithActiveThreshold sets the traffic, in bytes per second over all of
+// a player's interfaces but loopback, above which sonos_active is 1. The
+// default is DefaultActiveThreshold.
+func WithActiveThreshold(bytesPerSecond float64) Option {
+	return func(c *collector) {
+		c.activeThreshold = bytesPerSecond
+	}
+}
+
+// DefaultMaxResponseBytes is the default limit on the size of a
+// speaker's response. The largest, ifconfig and zone group state, are
+// tens of kilobytes.
+const DefaultMaxResponseBytes = 10 << 20
+
+// WithMaxResponseBytes limits how much of a speaker's response is read,
+// so a misbehaving speaker or proxy can't exhaust memory. A fetch whose
+// response is longer fails. Zero means no limit. The default is
+// DefaultMaxResponseBytes.
+func WithMaxResponseBytes(n int64) Option {
+	return func(c *collector) {
+		c.maxResponse = n
+	}
+}
+
+// DefaultDurationBuckets are the default buckets, in seconds, for
+// sonos_collection_duration_seconds. Scrapes usually take 50ms to 3s.
+var DefaultDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 10}
+
+// WithDurationBuckets sets the buckets, in seconds, of the
+// sonos_collection_duration_seconds histogram. They must be positive and
+// increasing.
+func WithDurationBuckets(buckets []float64) Option {
+	return func(c *collector) {
+		c.buckets = buckets
+	}
+}
+
+// WithSeeds discovers speakers from the zone group topology of the
+// speakers at seeds, each a host[:port], instead of via SSDP or targets.
+// Each seed's topology lists every speaker in its household, so one seed
+// per household is enough.
+func WithSeeds(seeds ...string) Option {
+	return func(c *collector) {
+		c.seeds = nil
+		for _, s := range seeds {
+			c.seeds = append(c.seeds, targetLocation(s))
+		}
+	}
+}
+
+// WithHostnames fills in sonos_speaker's hostname label by reverse DNS
+// lookups of each speaker's address. Lookups are cached for the
+// discovery cache's TTL, or five minutes without one.
+func WithHostnames() Option {
+	return func(c *collector) {
+		c.resolve = true
+	}
+}
+
+// WithTargetLabelTemplate fills in sonos_speaker's target_label label by
+// executing t on each speaker's *Device, for instance with
+// "{{.RoomName}}-{{.ModelNumber}}". Without a template, or if it fails
+// for a speaker, the label is the room name.
+func WithTargetLabelTemplate(t *template.Template) Option {
+	return func(c *collector) {
+		c.labelTemplate = t
+	}
+}
+
+// WithErrorHandler calls fn with each error the collector runs into,
+// besides logging it and counting it in sonos_collection_errors_total.
+// fn is called from the goroutines collecting each speaker, so it must be
+// safe to call concurrently and should return quickly.
+func WithErrorHandler(fn func(CollectError)) Option {
+	return func(c *collector) {
+		c.onError = fn
+	}
+}
+
+// StageTimeouts bound each stage of a scrape separately. A zero
+// Device, Ifconfig or SOAP timeout falls back to WithTimeout's. A zero
+// Discovery timeout leaves discovery to its own limits, since an SSDP
+// search listens for a fixed window rather than making a request.
+type StageTimeouts struct {
+	Discovery time.Duration
+	Device    time.Duration
+	Ifconfig  time.Duration
+	SOAP      time.Duration
+}
+
+// WithStageTimeouts sets per-stage timeouts, for tightening the fast
+// stages while giving the slow ones more time.
+func WithStageTimeouts(t StageTimeouts) Option {
+	return func(c *collector) {
+		c.stages = t
+	}
+}
+
+// WithLocalAPI prefers the JSON local API of newer firmware over SOAP
+// for what it can answer: volume, mute, transport state and the
+// household ID. Speakers without it fall back to SOAP. key is sent as
+// the X-Sonos-Api-Key header it requires. The local API's certificates
+// come from Sonos's own CA, so the collector's transport doesn't verify
+// them; a client given to WithHTTPClient with a Transport of its own
+// needs to do the same.
+func WithLocalAPI(key string) Option {
+	return func(c *collector) {
+		c.localAPI = true
+		c.localAPIKey = key
+	}
+}
+
+// WithEmptyScrapeRetry runs discovery a second time when it fails or
+// finds no speakers, as long as the scrape timeout hasn't passed, to ride
+// out a lost multicast search.
+func WithEmptyScrapeRetry() Option {
+	return func(c *collector) {
+		c.retryEmpty = true
+	}
+}
+
+// WithDeltaMode leaves info-style gauges, such as sonos_speaker, out of a
+// scrape when their value is unchanged since they were last sent, to
+// shrink scrapes over slow links. They're sent with explicit timestamps,
+// so Prometheus doesn't mark them stale when they're left out, and again
+// every four minutes even if unchanged, so they stay within its default
+// five minute lookback. A speaker that goes away leaves its series
+// queryable until the lookback has passed.
+func WithDeltaMode() Option {
+	return func(c *collector) {
+		c.delta = &deltaFilter{}
+	}
+}
+
+// WithEventing subscribes to each speaker's AVTransport and
+// RenderingControl events, serving the speakers' callbacks on l, and
+// reports the transport state and volume they carry. The speakers must
+// be able to connect back to l's port.
+func WithEventing(l net.Listener) Option {
+	return func(c *collector) {
+		c.events = newEventSubscriber(l)
+	}
+}
+
+// WithQuiet leaves routine messages, such as what discovery found and
+// which targets were skipped, out of the log. Errors are still logged.
+func WithQuiet() Option {
+	return func(c *collector) {
+		c.quiet = true
+	}
+}
+
+// NewCollector returns a collector for the Sonos speakers at targets,
+// each a host[:port] or a device description URL, optionally followed
+// by ";timeout=3s" to override the request timeout for that speaker.
+// With no targets, the speakers are discovered via SSDP on every scrape.
+func NewCollector(targets []string, opts ...Option) prometheus.Collector {
+	c := &collector{
+		discoverer:  ssdpDiscoverer{},
+		excludes:    make(map[string]bool),
+		regexps:     make(map[string]*regexp.Regexp),
+		cache:       newTargetCache(nil),
+		buckets:     DefaultDurationBuckets,
+		timeouts:    make(map[string]time.Duration),
+		maxResponse: DefaultMaxResponseBytes,
+
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sonos_collection_errors_total",
+				Help: "Errors observed when collecting devices, by target and stage; target is empty for discovery",
+			},
+			[]string{"target", "stage"},
+		),
+
+		parseDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "sonos_parse_duration_seconds",
+				Help:    "Time spent parsing each ifconfig interface block",
+				Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+			},
+		),
+
+		ssdpMaxResponseBytes: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "sonos_ssdp_max_response_bytes",
+				Help: "Largest SSDP response seen",
+			},
+			func() float64 { return float64(ssdpMaxResponse.Load()) },
+		),
+
+		ssdpLocations: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "sonos_ssdp_unique_locations",
+				Help: "Unique device locations found by the latest SSDP search",
+			},
+		),
+
+		counterResets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sonos_counter_resets_total",
+				Help: "Times an interface's byte counters went down since the previous scrape, as when the speaker reboots",
+			},
+			[]string{"player", "device"},
+		),
+		lastBytes: make(map[[2]string][2]float64),
+		resets:    make(map[[2]string]float64),
+
+		lastIfconfig:    make(map[string]time.Time),
+		actions:         make(map[[3]string]int),
+		activeThreshold: DefaultActiveThreshold,
+
+		emptyRetries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "sonos_empty_scrape_retries_total",
+				Help: "Scrapes whose discovery found nothing and was retried",
+			},
+		),
+
+		ssdpLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "sonos_ssdp_response_latency_seconds",
+				Help:    "Time from sending an SSDP search to each speaker's response",
+				Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2},
+			},
+			[]string{"ip"},
+		),
+
+		dnsLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sonos_dns_lookups_total",
+				Help: "DNS lookups of speakers' names (type=\"forward\") and addresses (type=\"reverse\")",
+			},
+			[]string{"type"},
+		),
+
+		dnsErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sonos_dns_lookup_errors_total",
+				Help: "Failed DNS lookups of speakers' names (type=\"forward\") and addresses (type=\"reverse\")",
+			},
+			[]string{"type"},
+		),
+
+		overlaps: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "sonos_scrape_overlaps_total",
+				Help: "Scrapes started while another was still running",
+			},
+		),
+
+		soapErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sonos_soap_errors_total",
+				Help: "Failed SOAP calls to speakers by action, which don't affect sonos_up",
+			},
+			[]string{"action"},
+		),
+
+		filtered: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sonos_targets_filtered_total",
+				Help: "Targets, or interfaces for filter=\"interface\", dropped by each filter",
+			},
+			[]string{"filter"},
+		),
+
+		parserInfo: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "sonos_parser_version",
+				Help:        "Version of the ifconfig parsing logic, in the version label",
+				ConstLabels: prometheus.Labels{"version": parserVersion},
+			},
+		),
+
+		goroutines: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "sonos_collect_goroutines_active",
+				Help: "Per-target collection goroutines currently running",
+			},
+		),
+	}
+
+	if len(targets) > 0 {
+		locs := make(staticDiscoverer, 0, len(targets))
+		for _, spec := range targets {
+			t, err := parseTarget(spec)
+			if err != nil {
+				log.Printf("Target %q: %s", spec, err)
+			}
+			locs = append(locs, t.loc)
+			if isHostName(t.loc) {
+				c.namedTargets = true
+			}
+
+			if t.timeout > 0 {
+				c.timeouts[targetHost(t.loc)] = t.timeout
+			}
+		}
+		c.discoverer = locs
+	}
+
+	for field, re := range defaultIfconfigRegexps {
+		c.regexps[field] = re
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.transport = c.newTransport()
+	switch {
+	case c.client == nil:
+		c.client = &http.Client{Transport: c.transport}
+	case c.client.Transport == nil:
+		client := *c.client
+		client.Transport = c.transport
+		c.client = &client
+	}
+
+	c.scrapeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "sonos_collection_duration_seconds",
+			Help:    "Time each scrape took to collect every speaker",
+			Buckets: c.buckets,
+		},
+	)
+
+	c.parserInfo.Set(1)
+
+	if c.stateFile != "" {
+		if err := c.loadState(); err != nil {
+			log.Printf("Loading state from %s: %s", c.stateFile, err)
+		}
+	}
+	for _, filter := range []string{"ssdp_udn", "udn", "subnet", "interface"} {
+		c.filtered.WithLabelValues(filter)
+	}
+	for _, typ := range []string{"forward", "reverse"} {
+		c.dnsLookups.WithLabelValues(typ)
+		c.dnsErrors.WithLabelValues(typ)
+	}
+
+	if c.resolve {
+		c.resolver = newHostResolver(c.cacheTTL)
+		c.resolver.lookups = c.dnsLookups
+		c.resolver.errors = c.dnsErrors
+	}
+
+	// Seeds replace both SSDP and targets, but not a WithDiscoverer.
+	if len(c.seeds) > 0 {
+		switch c.discoverer.(type) {
+		case ssdpDiscoverer, staticDiscoverer:
+			c.discoverer = &seedDiscoverer{seeds: c.seeds, c: c}
+		}
+
+		for _, seed := range c.seeds {
+			if isHostName(seed) {
+				c.namedTargets = true
+			}
+		}
+	}
+
+	switch d := c.discoverer.(type) {
+	case ssdpDiscoverer:
+		c.discoverer = c.ssdpDiscoverer()
+	case staticDiscoverer:
+		if c.alsoSSDP {
+			c.discoverer = mergedDiscoverer{d, c.ssdpDiscoverer()}
+		}
+	}
+
+	if c.cacheTTL > 0 {
+		c.discoverer = &cachingDiscoverer{
+			d:      c.discoverer,
+			ttl:    c.cacheTTL,
+			jitter: c.cacheJitter,
+		}
+	}
+
+	if c.fetcher == nil {
+		c.fetcher = &httpFetcher{
+			client:        c.client,
+			transport:     c.transport,
+			timeout:       c.httpTimeout,
+			timeouts:      c.timeouts,
+			stages:        c.stages,
+			regexps:       c.regexps,
+			parseDuration: c.parseDuration,
+			soapErrors:    c.soapErrors,
+			dnsLookups:    c.dnsLookups,
+			dnsErrors:     c.dnsErrors,
+			lenientXML:    c.lenientXML,
+			localAPIKey:   c.localAPIKey,
+			maxResponse:   c.maxResponse,
+		}
+	}
+
+	if c.events != nil {
+		if _, ok := c.fetcher.(*httpFetcher); ok {
+			go c.events.serve()
+		} else {
+			log.Printf("Eventing needs real speakers, ignoring it")
+			c.events = nil
+		}
+	}
+
+	return c
+}
+
+// newTransport returns the transport for c's requests to the speakers,
+// configured like http.DefaultTransport apart from dialing from
+// c.sourceIP if it's set and only to the allowed subnets, and not
+// verifying the local API's certificates if it's used.
+func (c *collector) newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if c.sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: c.sourceIP}
+	}
+	if len(c.subnets) > 0 {
+		dialer.Control = c.dialControl
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialer.DialContext
+	if c.localAPI {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return t
+}
+
+// CloseIdleConnections closes the collector's pooled connections to the
+// speakers. Only its own transport's are closed, not those of a client
+// given to WithHTTPClient with a Transport of its own.
+func (c *collector) CloseIdleConnections() {
+	if f, ok := c.fetcher.(*httpFetcher); ok {
+		f.closeIdleConnections()
+	}
+}
+
+// ssdpDiscoverer returns an SSDP discoverer configured by c's options.
+func (c *collector) ssdpDiscoverer() ssdpDiscoverer {
+	d := ssdpDiscoverer{
+		backoff:   c.ssdpBackoff,
+		ttl:       c.ssdpTTL,
+		quiet:     c.quiet,
+		locations: c.ssdpLocations,
+		filtered:  c.filtered.WithLabelValues("ssdp_udn"),
+		latency:   c.ssdpLatency,
+	}
+
+	if c.ssdpAllow {
+		d.allow = c.udnAllow
+		if d.allow == nil {
+			d.allow = make(map[string]bool)
+		}
+	}
+
+	return d
+}
+
+// Describe implements Prometheus.Collector.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	c.errors.Describe(ch)
+	c.parseDuration.Describe(ch)
+	c.ssdpMaxResponseBytes.Describe(ch)
+	c.ssdpLocations.Describe(ch)
+	c.goroutines.Describe(ch)
+	c.scrapeDuration.Describe(ch)
+	c.counterResets.Describe(ch)
+	c.parserInfo.Describe(ch)
+	c.emptyRetries.Describe(ch)
+	c.filtered.Describe(ch)
+	c.ssdpLatency.Describe(ch)
+	c.soapErrors.Describe(ch)
+	c.overlaps.Describe(ch)
+	c.dnsLookups.Describe(ch)
+	c.dnsErrors.Describe(ch)
+	if c.events != nil {
+		c.events.received.Describe(ch)
+	}
+}
+
+// Collect implements Prometheus.Collector.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	// Overlapping scrapes compete for the same concurrency slots and
+	// speakers, slowing each other down further.
+	if c.inFlight.Add(1) > 1 {
+		c.overlaps.Inc()
+	}
+	defer c.inFlight.Add(-1)
+
+	in := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		c.filter(in, ch)
+		close(done)
+	}()
+
+	c.scrape(in)
+	close(in)
+	<-done
+
+	c.errors.Collect(ch)
+	c.parseDuration.Collect(ch)
+	c.ssdpMaxResponseBytes.Collect(ch)
+	c.ssdpLocations.Collect(ch)
+	c.goroutines.Collect(ch)
+	c.scrapeDuration.Collect(ch)
+	c.counterResets.Collect(ch)
+	c.parserInfo.Collect(ch)
+	c.emptyRetries.Collect(ch)
+	c.filtered.Collect(ch)
+	c.ssdpLatency.Collect(ch)
+	c.soapErrors.Collect(ch)
+	c.overlaps.Collect(ch)
+	c.dnsLookups.Collect(ch)
+	c.dnsErrors.Collect(ch)
+	if c.events != nil {
+		c.events.received.Collect(ch)
+	}
+}
+
+// filter forwards a scrape's metrics from in to out, deduplicated and,
+// in delta mode, without unchanged info-style gauges.
+func (c *collector) filter(in <-chan prometheus.Metric, out chan<- prometheus.Metric) {
+	if c.delta == nil {
+		c.dedupe(in, out)
+		return
+	}
+
+	deduped := make(chan prometheus.Metric)
+	go func() {
+		c.dedupe(in, deduped)
+		close(deduped)
+	}()
+	c.delta.filter(deduped, out)
+}
+
+func (c *collector) scrape(ch chan<- prometheus.Metric) {
+	start := time.Now()
+
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	c.collectDiscoveryMode(ch)
+
+	locs, cache, err := c.discoverCached(ctx)
+	if c.retryEmpty && (err != nil || len(locs) == 0) && ctx.Err() == nil {
+		log.Printf("Discovery found nothing, retrying")
+		c.emptyRetries.Inc()
+		locs, cache, err = c.discoverCached(ctx)
+	}
+	if err != nil {
+		log.Printf("Search: %s", err)
+		c.fail("", "search", err)
+		return
+	}
+
+	if _, ok := c.discoverer.(*cachingDiscoverer); ok {
+		if !cache.refreshed.IsZero() {
+			ch <- prometheus.MustNewConstMetric(discoveryCacheAge, prometheus.GaugeValue, time.Since(cache.refreshed).Seconds())
+		}
+
+		var hit float64
+		if cache.hit {
+			hit = 1
+		}
+		ch <- prometheus.MustNewConstMetric(discoveryCacheHit, prometheus.GaugeValue, hit)
+	}
+
+	var topo *topology
+	if c.topology {
+		topo = c.fetchTopology(ctx, locs)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		devices = make(map[string]*Device)
+	)
+	wg.Add(len(locs))
+
+	for _, loc := range locs {
+		c.goroutines.Inc()
+		go func(loc string) {
+			defer wg.Done()
+			defer c.goroutines.Dec()
+
+			d, metrics := c.stageTarget(ctx, loc, topo)
+			if d != nil {
+				mu.Lock()
+				devices[loc] = d
+				mu.Unlock()
+			}
+
+			for _, m := range metrics {
+				ch <- m
+			}
+		}(loc)
+	}
+
+	wg.Wait()
+
+	collectCounts(ch, devices)
+	if topo != nil {
+		collectTopology(ch, topo)
+	}
+
+	if c.alarms {
+		c.collectAlarms(ctx, ch, devices)
+	}
+
+	// Pooled connections are kept by host name, so one to a speaker
+	// whose DHCP lease moved it would keep reaching the old address.
+	// Dropping them between scrapes makes each scrape resolve afresh.
+	if c.namedTargets {
+		c.CloseIdleConnections()
+	}
+
+	if c.stateFile != "" {
+		c.maybeSaveState()
+	}
+
+	elapsed := time.Since(start).Seconds()
+	c.scrapeDuration.Observe(elapsed)
+
+	ch <- prometheus.MustNewConstMetric(
+		collectionDuration,
+		prometheus.GaugeValue,
+		elapsed,
+	)
+}
+
+// Discover implements Discoverer, finding the speakers the next scrape
+// would collect. The collector returned by NewCollector can be asserted
+// to a Discoverer to check the configuration finds any.
+func (c *collector) Discover(ctx context.Context) ([]string, error) {
+	return c.discover(ctx)
+}
+
+// Refresh implements Refresher, dropping any cached discovery and
+// discovering speakers again. Scrapes from then on collect what it finds.
+// It's safe to call during a scrape: it waits for a discovery in
+// progress to finish first.
+func (c *collector) Refresh(ctx context.Context) ([]string, error) {
+	if d, ok := c.discoverer.(*cachingDiscoverer); ok {
+		d.invalidate()
+	}
+	return c.discover(ctx)
+}
+
+// discover runs the discoverer under the discovery stage timeout.
+func (c *collector) discover(ctx context.Context) ([]string, error) {
+	locs, _, err := c.discoverCached(ctx)
+	return locs, err
+}
+
+// discoverCached is discover, also returning how it went with the cache
+// if discovery is cached.
+func (c *collector) discoverCached(ctx context.Context) ([]string, cacheState, error) {
+	if c.stages.Discovery > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.stages.Discovery)
+		defer cancel()
+	}
+
+	if d, ok := c.discoverer.(*cachingDiscoverer); ok {
+		return d.discover(ctx)
+	}
+	locs, err := c.discoverer.Discover(ctx)
+	return locs, cacheState{}, err
+}
+
+// collectDiscoveryMode emits which of the discovery modes is in use.
+func (c *collector) collectDiscoveryMode(ch chan<- prometheus.Metric) {
+	mode := discoveryMode(c.discoverer)
+
+	known := false
+	for _, m := range discoveryModes {
+		var v float64
+		if m == mode {
+			v = 1
+			known = true
+		}
+		ch <- prometheus.MustNewConstMetric(discoveryModeDesc, prometheus.GaugeValue, v, m)
+	}
+
+	if !known {
+		ch <- prometheus.MustNewConstMetric(discoveryModeDesc, prometheus.GaugeValue, 1, mode)
+	}
+}
+
+// stageTarget collects loc under the concurrency limit, holding its
+// metrics rather than sending them on. The registry reads Collect's
+// channel as fast as it can, but it's unbuffered, so a slow reader would
+// otherwise keep every target's slot held, and the next targets waiting,
+// until it caught up. Staged, a target frees its slot as soon as its
+// fetches are done.
+func (c *collector) stageTarget(ctx context.Context, loc string, topo *topology) (*Device, []prometheus.Metric) {
+	if !c.acquire(ctx) {
+		return nil, []prometheus.Metric{
+			prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0, targetHost(loc)),
+		}
+	}
+	defer c.release()
+
+	var metrics []prometheus.Metric
+
+	stage := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range stage {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+
+	d := c.collectTarget(ctx, stage, loc, topo)
+	close(stage)
+	<-done
+
+	return d, metrics
+}
+
+// acquire waits for a slot under the concurrency limit, returning false
+// if ctx is done first.
+func (c *collector) acquire(ctx context.Context) bool {
+	if c.sem == nil {
+		return true
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *collector) release() {
+	if c.sem != nil {
+		<-c.sem
+	}
+}
+
+// targetHost returns the host of the location loc, which labels the
+// target in sonos_up however far its collection got. A location that
+// doesn't parse is cut down to what would have been its host, so it's
+// labeled the same way as the rest.
+func targetHost(loc string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		_, rest, ok := strings.Cut(loc, "://")
+		if !ok {
+			rest = loc
+		}
+		host, _, _ := strings.Cut(rest, "/")
+		return host
+	}
+	return u.Host
+}
+
+// isHostName reports whether loc's host is a name to be resolved rather
+// than an IP address.
+func isHostName(loc string) bool {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return false
+	}
+	return net.ParseIP(u.Hostname()) == nil
+}
+
+// collectCounts emits how many rooms and speakers there are among
+// devices, and how many speakers of each model. Stereo pairs and home
+// theater setups have more speakers than rooms. The distinct UDNs and
+// serial numbers are emitted apart too: each speaker has one of each, so
+// a difference means the same speaker was collected at two locations or
+// reported an identifier wrongly.
+func collectCounts(ch chan<- prometheus.Metric, devices map[string]*Device) {
+	rooms := make(map[string]bool)
+	serials := make(map[string]bool)
+	udns := make(map[string]bool)
+	models := make(map[string]int)
+
+	for _, d := range devices {
+		rooms[d.RoomName] = true
+		udns[normalizeUDN(d.UDN)] = true
+		if !serials[d.SerialNum] {
+			models[d.ModelName]++
+		}
+		serials[d.SerialNum] = true
+	}
+
+	ch <- prometheus.MustNewConstMetric(roomCount, prometheus.GaugeValue, float64(len(rooms)))
+	ch <- prometheus.MustNewConstMetric(speakerCount, prometheus.GaugeValue, float64(len(serials)))
+	ch <- prometheus.MustNewConstMetric(distinctUDNs, prometheus.GaugeValue, float64(len(udns)))
+	ch <- prometheus.MustNewConstMetric(distinctSerials, prometheus.GaugeValue, float64(len(serials)))
+
+	for model, n := range models {
+		ch <- prometheus.MustNewConstMetric(devicesByModel, prometheus.GaugeValue, float64(n), model)
+	}
+}
+
+// collectTarget collects loc, or replays its cached metrics if its model
+// isn't due for a fetch this scrape. It returns loc's device description,
+// or nil if that couldn't be fetched.
+func (c *collector) collectTarget(ctx context.Context, ch chan<- prometheus.Metric, loc string, topo *topology) *Device {
+	if t, ok := c.cache.get(loc); ok {
+		for _, m := range t.metrics {
+			ch <- m
+		}
+		ch <- prometheus.MustNewConstMetric(speakerCached, prometheus.GaugeValue, 1, t.device.RoomName, t.device.SerialNum)
+		return t.device
+	}
+
+	var metrics []prometheus.Metric
+
+	tee := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range tee {
+			metrics = append(metrics, m)
+			ch <- m
+		}
+		close(done)
+	}()
+
+	d := c.collect(ctx, tee, loc, topo)
+	close(tee)
+	<-done
+
+	if d == nil {
+		return nil
+	}
+
+	if c.alarms {
+		d.HouseholdID = c.collectHouseholdID(ctx, loc, d)
+	}
+
+	ch <- prometheus.MustNewConstMetric(speakerCached, prometheus.GaugeValue, 0, d.RoomName, d.SerialNum)
+	c.cache.put(loc, d, metrics)
+
+	return d
+}
+
+// collect emits the metrics for the speaker at loc and returns its device
+// description, or nil if that couldn't be fetched. topo, if not nil, has
+// the room of the speaker's group coordinator.
+func (c *collector) collect(ctx context.Context, ch chan<- prometheus.Metric, loc string, topo *topology) *Device {
+	base, err := url.Parse(loc)
+	if err != nil {
+		log.Printf("Parse %s: %s", loc, err)
+		c.fail(targetHost(loc), "parse", err)
+		ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0, targetHost(loc))
+		return nil
+	}
+
+	// Each fetch below is independent: a failure is logged and counted,
+	// but doesn't keep the others from emitting what they can. Only the
+	// device description and ifconfig count towards up; the SOAP calls
+	// after them are extras that some models or firmware lack. Until the
+	// device description is known, the target's host stands in for the
+	// player name, and the serial number is left empty.
+	player, serial := base.Host, ""
+	ok := 1.0
+
+	d, err := c.collectDevice(ctx, ch, base)
+	if err == errNotAllowed {
+		return nil
+	}
+
+	var unreachable float64
+	if err != nil {
+		ok = 0
+		unreachable = 1
+	} else {
+		player, serial = d.RoomName, d.SerialNum
+	}
+
+	ch <- prometheus.MustNewConstMetric(discoveredUnreachable, prometheus.GaugeValue, unreachable, base.Host)
+
+	if err := c.collectIfconfig(ctx, ch, base, player, serial); err != nil {
+		ok = 0
+	}
+
+	// Without a device description there's nothing to call the SOAP
+	// extras with, and a speaker that didn't answer for it would likely
+	// only time out each of them in turn.
+	if d != nil {
+		c.collectActions(ctx, ch, base, d)
+		c.collectClock(ctx, ch, base, d, player, serial)
+		c.collectLineIn(ctx, ch, base, d, player, serial)
+		coordinator := topo.coordinatorRoom(d, player)
+		local := c.collectLocal(ctx, base)
+		c.collectRendering(ctx, ch, base, d, local, player, serial, coordinator)
+		c.collectTransport(ctx, ch, base, d, local, player, serial, coordinator)
+		if c.events != nil {
+			c.collectEvents(ctx, base, d)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, ok, base.Host)
+
+	return d
+}
+
+// errOutsideSubnets is returned by dials to addresses outside the
+// allowed subnets.
+var errOutsideSubnets = errors.New("outside the allowed subnets")
+
+// dialControl refuses connections to addresses outside the allowed
+// subnets. It checks the address actually dialed, after any DNS lookup
+// and for every redirect, so neither a name that resolves elsewhere nor
+// a speaker redirecting elsewhere gets past it.
+func (c *collector) dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	// Strip any IPv6 zone, as in fe80::1%eth0.
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !c.inSubnets(ip) {
+		return fmt.Errorf("%s is %w", host, errOutsideSubnets)
+	}
+	return nil
+}
+
+func (c *collector) inSubnets(ip net.IP) bool {
+	for _, n := range c.subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetLabel returns d's target_label: the label template executed on
+// d, or its room name.
+func (c *collector) targetLabel(d *Device) string {
+	if c.labelTemplate == nil {
+		return d.RoomName
+	}
+
+	var b strings.Builder
+	if err := c.labelTemplate.Execute(&b, d); err != nil {
+		log.Printf("Target label for %s: %s", d.RoomName, err)
+		return d.RoomName
+	}
+	return b.String()
+}
+
+// hostname returns the hostname of base's host if WithHostnames is set,
+// and "" otherwise.
+func (c *collector) hostname(ctx context.Context, base *url.URL) string {
+	if c.resolver == nil {
+		return ""
+	}
+	return c.resolver.hostname(ctx, base.Hostname())
+}
+
+func (c *collector) collectDevice(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL) (*Device, error) {
+	d, err := c.fetcher.fetchDevice(ctx, base)
+	if errors.Is(err, errOutsideSubnets) {
+		c.infof("Skipping %s: %s", base, err)
+		c.filtered.WithLabelValues("subnet").Inc()
+		return nil, errNotAllowed
+	}
+	if err != nil {
+		log.Printf("Get info %s: %s", base, err)
+		c.fail(base.Host, "device", err)
+		return nil, err
+	}
+
+	if c.udnAllow != nil && !c.udnAllow[normalizeUDN(d.UDN)] {
+		c.infof("Skipping %s: UDN %q not allowed", base, d.UDN)
+		c.filtered.WithLabelValues("udn").Inc()
+		return nil, errNotAllowed
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		speakerInfo,
+		prometheus.GaugeValue,
+		1,
+		d.RoomName,
+		d.DisplayVersion,
+		d.HardwareVersion,
+		d.ModelName,
+		d.ModelNumber,
+		d.SerialNum,
+		d.MACSerial(),
+		d.SoftwareVersion,
+		d.UDN,
+		base.Hostname(),
+		c.hostname(ctx, base),
+		c.targetLabel(d),
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		firmwareGeneration,
+		prometheus.GaugeValue,
+		1,
+		d.RoomName,
+		d.UDN,
+		d.Generation(),
+	)
+
+	var nonASCII float64
+	if hasNonASCII(d.RoomName) {
+		nonASCII = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		roomNameNonASCII,
+		prometheus.GaugeValue,
+		nonASCII,
+		d.RoomName,
+		d.SerialNum,
+	)
+
+	if d.ConnectLatency > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			connectLatency,
+			prometheus.GaugeValue,
+			d.ConnectLatency.Seconds(),
+			base.Host,
+		)
+	}
+
+	var visible float64
+	if d.Visible() {
+		visible = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		deviceVisible,
+		prometheus.GaugeValue,
+		visible,
+		d.RoomName,
+		d.UDN,
+	)
+
+	return d, nil
+}
+
+func (c *collector) collectIfconfig(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, player, serial string) error {
+	// A body that doesn't decode cleanly may still have given up some
+	// interfaces, which are emitted anyway. The error still counts
+	// against up.
+	ifaces, err := c.fetcher.fetchIfconfig(ctx, base)
+	if err != nil {
+		log.Printf("Get ifconfig %s: %s", base, err)
+		c.fail(base.Host, "ifconfig", err)
+		if len(ifaces) == 0 {
+			return err
+		}
+	}
+
+	var (
+		down  int
+		moved float64
+		known bool
+	)
+
+	for device, stats := range ifaces {
+		if c.excludes[device] {
+			c.filtered.WithLabelValues("interface").Inc()
+			continue
+		}
+
+		if n, ok := c.checkReset(base, player, device, stats); ok && device != "lo" {
+			moved += n
+			known = true
+		}
+
+		var ifaceUp float64
+		if stats.up {
+			ifaceUp = 1
+		} else {
+			down++
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			interfaceUp,
+			prometheus.GaugeValue,
+			ifaceUp,
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			interfaceFieldsParsed,
+			prometheus.GaugeValue,
+			float64(stats.fieldsParsed),
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			interfaceAddress,
+			prometheus.GaugeValue,
+			1,
+			player,
+			serial,
+			device,
+			stats.ipv4,
+			stats.ipv6,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			rxBytes,
+			prometheus.GaugeValue,
+			stats.rxBytes,
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			rxPackets,
+			prometheus.GaugeValue,
+			stats.rxPackets,
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			txBytes,
+			prometheus.GaugeValue,
+			stats.txBytes,
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			txPackets,
+			prometheus.GaugeValue,
+			stats.txPackets,
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			rxAvgPacketBytes,
+			prometheus.GaugeValue,
+			perPacket(stats.rxBytes, stats.rxPackets),
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			txAvgPacketBytes,
+			prometheus.GaugeValue,
+			perPacket(stats.txBytes, stats.txPackets),
+			player,
+			serial,
+			device,
+		)
+
+		// Emitted for every interface, zero or not, so the series
+		// don't have gaps.
+		ch <- prometheus.MustNewConstMetric(
+			collisions,
+			prometheus.CounterValue,
+			stats.collisions,
+			player,
+			serial,
+			device,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			txQueueLen,
+			prometheus.GaugeValue,
+			stats.txQueueLen,
+			player,
+			serial,
+			device,
+		)
+
+		if stats.mtu > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				interfaceMTU,
+				prometheus.GaugeValue,
+				stats.mtu,
+				player,
+				serial,
+				device,
+			)
+		}
+
+		if stats.speed > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				interfaceSpeed,
+				prometheus.GaugeValue,
+				stats.speed,
+				player,
+				serial,
+				device,
+			)
+		}
+
+		if stats.hasRxBacklog {
+			ch <- prometheus.MustNewConstMetric(
+				rxBacklog,
+				prometheus.GaugeValue,
+				stats.rxBacklog,
+				player,
+				serial,
+				device,
+			)
+		}
+
+		if stats.hasTxBacklog {
+			ch <- prometheus.MustNewConstMetric(
+				txBacklog,
+				prometheus.GaugeValue,
+				stats.txBacklog,
+				player,
+				serial,
+				device,
+			)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		interfacesDown,
+		prometheus.GaugeValue,
+		float64(down),
+		player,
+		serial,
+	)
+
+	c.collectActive(ch, base, player, serial, moved, known)
+
+	return err
+}
+
+// collectActive emits whether the player at base moved more than the
+// active threshold's worth of traffic since its previous ifconfig fetch,
+// given the bytes moved since then. It's skipped when that's unknown, on
+// the first fetch and after a counter reset.
+func (c *collector) collectActive(ch chan<- prometheus.Metric, base *url.URL, player, serial string, moved float64, known bool) {
+	now := time.Now()
+
+	c.lastMu.Lock()
+	last, ok := c.lastIfconfig[base.Host]
+	c.lastIfconfig[base.Host] = now
+	c.lastMu.Unlock()
+
+	elapsed := now.Sub(last).Seconds()
+	if !ok || !known || elapsed <= 0 {
+		return
+	}
+
+	var v float64
+	if moved/elapsed > c.activeThreshold {
+		v = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(active, prometheus.GaugeValue, v, player, serial)
+}
+
+// collectHouseholdID returns the household of the speaker at loc, or ""
+// if it can't be fetched.
+func (c *collector) collectHouseholdID(ctx context.Context, loc string, d *Device) string {
+	base, err := url.Parse(loc)
+	if err != nil {
+		return ""
+	}
+
+	if c.localAPI {
+		info, err := c.fetcher.fetchLocalInfo(ctx, base)
+		if err == nil && info.HouseholdID != "" {
+			return info.HouseholdID
+		}
+		c.infof("Local API %s: %v, falling back to SOAP", loc, err)
+	}
+
+	id, err := c.fetcher.fetchHouseholdID(ctx, base, d)
+	if err != nil {
+		log.Printf("Get household %s: %s", loc, err)
+		c.fail(base.Host, "household", err)
+		return ""
+	}
+
+	return id
+}
+
+// collectClock emits the speaker's clock skew. It's a diagnostic extra,
+// so a failure doesn't count against the target being up.
+func (c *collector) collectClock(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device, player, serial string) {
+	skew, err := c.fetcher.fetchTime(ctx, base, d)
+	if err != nil {
+		log.Printf("Get time %s: %s", base, err)
+		c.fail(base.Host, "time", err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		clockSkew,
+		prometheus.GaugeValue,
+		skew.Seconds(),
+		player,
+		serial,
+	)
+}
+
+// checkReset counts a reset of the interface's counters if its rx or
+// tx bytes are lower than at the previous scrape. The first scrape of an
+// interface has nothing to compare with. It returns the bytes moved
+// since the previous scrape, and false if that isn't known.
+func (c *collector) checkReset(base *url.URL, player, device string, s stats) (float64, bool) {
+	key := [2]string{base.Host, device}
+
+	c.lastMu.Lock()
+	defer c.lastMu.Unlock()
+
+	last, ok := c.lastBytes[key]
+	c.lastBytes[key] = [2]float64{s.rxBytes, s.txBytes}
+
+	if !ok {
+		return 0, false
+	}
+	if s.rxBytes < last[0] || s.txBytes < last[1] {
+		c.counterResets.WithLabelValues(player, device).Inc()
+		c.resets[[2]string{player, device}]++
+		return 0, false
+	}
+
+	return s.rxBytes - last[0] + s.txBytes - last[1], true
+}
+
+// infof logs a routine message, unless WithQuiet is set.
+func (c *collector) infof(format string, args ...interface{}) {
+	if !c.quiet {
+		log.Printf(format, args...)
+	}
+}
+
+func hasNonASCII(s string) bool {
+	for _, r := range s {
+		if r >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// perPacket returns the average bytes per packet, or 0 with no packets.
+func perPacket(bytes, packets float64) float64 {
+	if packets == 0 {
+		return 0
+	}
+	return bytes / packets
+}
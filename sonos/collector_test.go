@@ -0,0 +1,329 @@
+package sonos
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// deviceDescription is a speaker's device description, trimmed to what
+// the collector reads.
+const deviceDescription = `<?xml version="1.0" encoding="utf-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:ZonePlayer:1</deviceType>
+    <roomName>Kitchen</roomName>
+    <displayVersion>15.9</displayVersion>
+    <hardwareVersion>1.20.1.6-2.1</hardwareVersion>
+    <modelName>Sonos One</modelName>
+    <modelNumber>S18</modelNumber>
+    <serialNum>78-28-CA-0F-8B-0A:3</serialNum>
+    <softwareVersion>75.1-42160</softwareVersion>
+    <UDN>uuid:RINCON_7828CA0F8B0A01400</UDN>
+  </device>
+</root>`
+
+// newSpeaker starts a fake speaker serving handlers by path, and returns
+// its host:port for use as a target. Like real firmware, it answers any
+// other path with a 404.
+func newSpeaker(t *testing.T, handlers map[string]http.HandlerFunc) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	for path, h := range handlers {
+		mux.HandleFunc(path, h)
+	}
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv.Listener.Addr().String()
+}
+
+// serve returns a handler answering every request with body.
+func serve(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}
+}
+
+// fail returns a handler answering every request with status.
+func fail(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// gather collects c once and returns its metrics by name.
+func gather(t *testing.T, c prometheus.Collector) map[string][]*dto.Metric {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %s", err)
+	}
+
+	ret := make(map[string][]*dto.Metric)
+	for _, mf := range mfs {
+		ret[mf.GetName()] = mf.GetMetric()
+	}
+	return ret
+}
+
+// labels returns m's labels by name.
+func labels(m *dto.Metric) map[string]string {
+	ret := make(map[string]string)
+	for _, l := range m.GetLabel() {
+		ret[l.GetName()] = l.GetValue()
+	}
+	return ret
+}
+
+// value returns the value of m, whatever its type.
+func value(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	default:
+		return m.GetUntyped().GetValue()
+	}
+}
+
+func TestCollect_IfconfigFails(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            fail(http.StatusInternalServerError),
+	})
+
+	metrics := gather(t, NewCollector([]string{target}))
+
+	speakers := metrics["sonos_speaker"]
+	if len(speakers) != 1 {
+		t.Fatalf("got %d sonos_speaker, want 1", len(speakers))
+	}
+	if got := labels(speakers[0])["room_name"]; got != "Kitchen" {
+		t.Errorf("sonos_speaker room_name = %q, want Kitchen", got)
+	}
+
+	if got := metrics["sonos_rx_bytes"]; len(got) != 0 {
+		t.Errorf("got %d sonos_rx_bytes with ifconfig failing, want 0", len(got))
+	}
+
+	ups := metrics["sonos_up"]
+	if len(ups) != 1 || value(ups[0]) != 0 {
+		t.Errorf("sonos_up = %v, want a single 0", ups)
+	}
+
+	var failed bool
+	for _, m := range metrics["sonos_collection_errors_total"] {
+		l := labels(m)
+		if l["target"] == target && l["stage"] == "ifconfig" && value(m) == 1 {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Errorf("no sonos_collection_errors_total for stage ifconfig")
+	}
+}
+
+func TestCollect_DeviceFails(t *testing.T) {
+	var soapCalls atomic.Int32
+	countCall := func(w http.ResponseWriter, r *http.Request) {
+		soapCalls.Add(1)
+	}
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml":             fail(http.StatusInternalServerError),
+		"/status/ifconfig":                        serve(ifconfigResponse(ifconfigSample)),
+		"/AlarmClock/Control":                     countCall,
+		"/MediaRenderer/RenderingControl/Control": countCall,
+		"/MediaRenderer/AVTransport/Control":      countCall,
+	})
+
+	metrics := gather(t, NewCollector([]string{target}))
+
+	if got := len(metrics["sonos_rx_bytes"]); got != 2 {
+		t.Errorf("got %d sonos_rx_bytes, want ifconfig's despite the device description failing", got)
+	}
+	if n := soapCalls.Load(); n != 0 {
+		t.Errorf("got %d SOAP calls without a device description, want none", n)
+	}
+}
+
+func TestTargetHost(t *testing.T) {
+	for _, tt := range []struct {
+		loc, want string
+	}{
+		{"http://192.168.1.20:1400/xml/device_description.xml", "192.168.1.20:1400"},
+		{"http://kitchen.local:1400/xml/device_description.xml", "kitchen.local:1400"},
+
+		// Locations that don't parse are labeled by their host all
+		// the same.
+		{"http://192.168.1.20:1400/xml/%zz", "192.168.1.20:1400"},
+		{"192.168.1.20:1400/%zz", "192.168.1.20:1400"},
+	} {
+		if got := targetHost(tt.loc); got != tt.want {
+			t.Errorf("targetHost(%q) = %q, want %q", tt.loc, got, tt.want)
+		}
+	}
+}
+
+func TestCollect_SlowConsumer(t *testing.T) {
+	const speakers = 3
+
+	var fetched atomic.Int32
+	var targets []string
+	for i := 0; i < speakers; i++ {
+		targets = append(targets, newSpeaker(t, map[string]http.HandlerFunc{
+			"/xml/device_description.xml": serve(deviceDescription),
+			"/status/ifconfig": func(w http.ResponseWriter, r *http.Request) {
+				fetched.Add(1)
+				serve(ifconfigResponse(ifconfigSample))(w, r)
+			},
+		}))
+	}
+
+	c := NewCollector(targets, WithMaxConcurrency(1))
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	// Stop reading partway through the first target's metrics. The
+	// others are fetched all the same, as none holds the one slot while
+	// waiting on the reader.
+	for m := range ch {
+		if m.Desc() == up {
+			break
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fetched.Load() < speakers && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fetched.Load(); got != speakers {
+		t.Errorf("fetched %d targets while the reader stalled, want %d", got, speakers)
+	}
+
+	for range ch {
+	}
+}
+
+func TestIsHostName(t *testing.T) {
+	for _, tt := range []struct {
+		target string
+		want   bool
+	}{
+		{"living-room.local", true},
+		{"living-room.local:1400", true},
+		{"192.168.1.20", false},
+		{"[fe80::7a28:caff:fe0f:8b0a]:1400", false},
+	} {
+		if got := isHostName(targetLocation(tt.target)); got != tt.want {
+			t.Errorf("isHostName(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCollect_NamedTarget(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(ifconfigResponse(ifconfigSample)),
+	})
+	_, port, _ := net.SplitHostPort(target)
+	named := net.JoinHostPort("localhost", port)
+
+	c := NewCollector([]string{named})
+	if !c.(*collector).namedTargets {
+		t.Errorf("%s isn't taken as a named target", named)
+	}
+
+	// Collected twice, resolving the name afresh for the second.
+	for i := 0; i < 2; i++ {
+		ups := gather(t, c)["sonos_up"]
+		if len(ups) != 1 || value(ups[0]) != 1 || labels(ups[0])["target"] != named {
+			t.Errorf("scrape %d: sonos_up = %v, want 1 for %s", i, ups, named)
+		}
+	}
+}
+
+func TestNewCollector_Transport(t *testing.T) {
+	c := NewCollector(nil).(*collector)
+	if c.client.Transport != c.transport || c.transport == http.DefaultTransport {
+		t.Errorf("default client's transport isn't the collector's own")
+	}
+
+	noFollow := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	c = NewCollector(nil, WithHTTPClient(noFollow)).(*collector)
+	if c.client.Transport != c.transport || c.client.CheckRedirect == nil {
+		t.Errorf("client without a transport isn't given the collector's, keeping CheckRedirect")
+	}
+	if noFollow.Transport != nil {
+		t.Errorf("the given client was changed")
+	}
+}
+
+func TestCollect_AllowedSubnets(t *testing.T) {
+	// The speaker outside the allowed subnet listens on another loopback
+	// address, which Linux routes but the allowlist leaves out.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Can't listen on 127.0.0.2: %s", err)
+	}
+	var outsideHits atomic.Int32
+	outside := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outsideHits.Add(1)
+		w.Write([]byte(deviceDescription))
+	}))
+	outside.Listener.Close()
+	outside.Listener = l
+	outside.Start()
+	t.Cleanup(outside.Close)
+
+	redirecting := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, outside.URL+r.URL.Path, http.StatusFound)
+		},
+	})
+
+	_, allowed, _ := net.ParseCIDR("127.0.0.1/32")
+
+	for _, target := range []string{l.Addr().String(), redirecting} {
+		mfs := gather(t, NewCollector([]string{target}, WithAllowedSubnets(allowed)))
+
+		if ups := mfs["sonos_up"]; len(ups) != 0 {
+			t.Errorf("%s: sonos_up = %v, want none", target, ups)
+		}
+		var filtered float64
+		for _, m := range mfs["sonos_targets_filtered_total"] {
+			if labels(m)["filter"] == "subnet" {
+				filtered = value(m)
+			}
+		}
+		if filtered != 1 {
+			t.Errorf("%s: subnet filtered = %v, want 1", target, filtered)
+		}
+	}
+
+	if n := outsideHits.Load(); n != 0 {
+		t.Errorf("speaker outside the allowed subnets got %d requests", n)
+	}
+}
@@ -0,0 +1,70 @@
+package sonos
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// dedupe forwards the metrics from in to out until in is closed,
+// dropping any series already sent, as the registry fails the whole
+// scrape on a series collected twice. Speakers bonded into one room, such
+// as a stereo pair, share a player name but are told apart by serial_num,
+// so what's left to drop is the same speaker reached at two locations,
+// whose series are alike whichever is sent. That's a misconfiguration, so
+// each scrape with drops logs a warning, even when quiet, counting them
+// and naming the first.
+func (c *collector) dedupe(in <-chan prometheus.Metric, out chan<- prometheus.Metric) {
+	seen := make(map[string]bool)
+	var dropped int
+	var first string
+	for m := range in {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			out <- m
+			continue
+		}
+
+		key := seriesKey(m.Desc(), pb.Label)
+		if seen[key] {
+			if dropped == 0 {
+				first = descName(m.Desc()) + labelString(pb.Label)
+			}
+			dropped++
+			continue
+		}
+		seen[key] = true
+
+		out <- m
+	}
+
+	if dropped > 0 {
+		log.Printf("Dropped %d duplicate series, such as %s; is a speaker found at two locations?", dropped, first)
+	}
+}
+
+// descName returns desc's metric name, which Desc only offers as part of
+// its String.
+func descName(desc *prometheus.Desc) string {
+	if m := descNameRe.FindStringSubmatch(desc.String()); len(m) > 1 {
+		return m[1]
+	}
+	return desc.String()
+}
+
+var descNameRe = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// labelString formats labels as {name="value",...} for logging.
+func labelString(labels []*dto.LabelPair) string {
+	s := "{"
+	for i, l := range labels {
+		if i > 0 {
+			s += ","
+		}
+		s += l.GetName() + "=" + strconv.Quote(l.GetValue())
+	}
+	return s + "}"
+}
@@ -0,0 +1,73 @@
+package sonos
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCollect_StereoPair(t *testing.T) {
+	// The pair's second speaker shares the Kitchen room name.
+	right := strings.NewReplacer(
+		"78-28-CA-0F-8B-0A:3", "78-28-CA-0F-8B-0B:3",
+		"RINCON_7828CA0F8B0A01400", "RINCON_7828CA0F8B0B01400",
+	).Replace(deviceDescription)
+
+	var targets []string
+	for _, desc := range []string{deviceDescription, right} {
+		targets = append(targets, newSpeaker(t, map[string]http.HandlerFunc{
+			"/xml/device_description.xml": serve(desc),
+			"/status/ifconfig":            serve(ifconfigResponse(ifconfigSample)),
+		}))
+	}
+
+	metrics := gather(t, NewCollector(targets))
+
+	serials := make(map[string]int)
+	for _, m := range metrics["sonos_rx_bytes"] {
+		serials[labels(m)["serial_num"]]++
+	}
+	want := map[string]int{"78-28-CA-0F-8B-0A:3": 2, "78-28-CA-0F-8B-0B:3": 2}
+	for serial, n := range want {
+		if serials[serial] != n {
+			t.Errorf("got sonos_rx_bytes by serial_num %v, want %v", serials, want)
+			break
+		}
+	}
+}
+
+func TestCollect_SameSpeakerTwice(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(ifconfigResponse(ifconfigSample)),
+	})
+	c := NewCollector([]string{target, targetLocation(target) + "?again"})
+
+	// One speaker found at two locations has its series sent once, and
+	// the drops are warned about on every scrape, in a single line.
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+
+		if got := len(gather(t, c)["sonos_rx_bytes"]); got != 2 {
+			t.Errorf("scrape %d: got %d sonos_rx_bytes, want one each for lo and eth0", i, got)
+		}
+
+		if n := strings.Count(buf.String(), "duplicate series"); n != 1 {
+			t.Errorf("scrape %d: logged duplicates %d times, want once", i, n)
+		}
+	}
+
+	// Quiet, they're still logged.
+	buf.Reset()
+	gather(t, NewCollector([]string{target, targetLocation(target) + "?again"}, WithQuiet()))
+	if !strings.Contains(buf.String(), "duplicate series") {
+		t.Errorf("didn't log duplicates with WithQuiet")
+	}
+}
@@ -0,0 +1,94 @@
+package sonos
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// deltaDescs are the info-style gauges delta mode may leave out. Their
+// values only change when a speaker's setup does.
+var deltaDescs = map[*prometheus.Desc]bool{
+	speakerInfo:        true,
+	firmwareGeneration: true,
+	deviceVisible:      true,
+	roomNameNonASCII:   true,
+	discoveryModeDesc:  true,
+	interfaceAddress:   true,
+}
+
+// deltaRefresh is how long delta mode leaves an unchanged series out
+// before sending it again. It's under Prometheus's default five minute
+// lookback, so queries keep finding the series in between.
+const deltaRefresh = 4 * time.Minute
+
+// deltaFilter drops info-style gauges whose value is the same as when
+// they were last sent, for up to deltaRefresh.
+type deltaFilter struct {
+	mu   sync.Mutex
+	last map[string]deltaSeries
+}
+
+// deltaSeries is the value a series was last sent with, and when.
+type deltaSeries struct {
+	value float64
+	sent  time.Time
+}
+
+// filter forwards the metrics from in to out, leaving out unchanged
+// info-style gauges, until in is closed. Series that weren't in this
+// scrape are forgotten, so they're sent again if they come back.
+//
+// The info-style gauges that are sent carry the scrape's time as an
+// explicit timestamp. Prometheus doesn't mark series with explicit
+// timestamps stale when a scrape leaves them out, as it does others
+// right away; they're found by queries until the lookback after their
+// last sample has passed.
+func (f *deltaFilter) filter(in <-chan prometheus.Metric, out chan<- prometheus.Metric) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+
+	seen := make(map[string]deltaSeries)
+	for m := range in {
+		if !deltaDescs[m.Desc()] {
+			out <- m
+			continue
+		}
+
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil || pb.Gauge == nil {
+			out <- m
+			continue
+		}
+
+		key := seriesKey(m.Desc(), pb.Label)
+		v := pb.Gauge.GetValue()
+
+		if last, ok := f.last[key]; ok && last.value == v && now.Sub(last.sent) < deltaRefresh {
+			seen[key] = last
+			continue
+		}
+
+		seen[key] = deltaSeries{value: v, sent: now}
+		out <- prometheus.NewMetricWithTimestamp(now, m)
+	}
+
+	f.last = seen
+}
+
+// seriesKey identifies the series of desc with labels.
+func seriesKey(desc *prometheus.Desc, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(pairs)
+
+	return desc.String() + "\xff" + strings.Join(pairs, "\xff")
+}
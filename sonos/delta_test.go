@@ -0,0 +1,85 @@
+package sonos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// deltaScrape runs ms through f as one scrape, returning what it sends.
+func deltaScrape(f *deltaFilter, ms ...prometheus.Metric) []*dto.Metric {
+	in := make(chan prometheus.Metric)
+	out := make(chan prometheus.Metric, len(ms))
+	go func() {
+		for _, m := range ms {
+			in <- m
+		}
+		close(in)
+	}()
+	f.filter(in, out)
+	close(out)
+
+	var ret []*dto.Metric
+	for m := range out {
+		var pb dto.Metric
+		m.Write(&pb)
+		ret = append(ret, &pb)
+	}
+	return ret
+}
+
+func TestDeltaFilter(t *testing.T) {
+	info := func(v float64) prometheus.Metric {
+		return prometheus.MustNewConstMetric(roomNameNonASCII, prometheus.GaugeValue, v, "Kitchen", "78-28-CA-0F-8B-0A:3")
+	}
+	target := prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1, "192.168.1.20:1400")
+
+	// A state gauge is sent on every scrape, however long it's unchanged.
+	state := prometheus.MustNewConstMetric(transportState, prometheus.GaugeValue, 1, "Kitchen", "78-28-CA-0F-8B-0A:3", "Kitchen", "PLAYING")
+
+	f := &deltaFilter{}
+
+	for i, tt := range []struct {
+		info   float64
+		before func()
+		want   int
+	}{
+		{0, nil, 3},
+		{0, nil, 2}, // Unchanged, so left out.
+		{1, nil, 3}, // Changed.
+		{1, func() {
+			// Unchanged, but due to be sent again.
+			for key, s := range f.last {
+				s.sent = s.sent.Add(-deltaRefresh)
+				f.last[key] = s
+			}
+		}, 3},
+	} {
+		if tt.before != nil {
+			tt.before()
+		}
+
+		got := deltaScrape(f, info(tt.info), target, state)
+		if len(got) != tt.want {
+			t.Errorf("scrape %d: sent %d metrics, want %d", i, len(got), tt.want)
+		}
+
+		// Only the info-style gauge is timestamped, so Prometheus
+		// doesn't mark it stale when it's left out.
+		for _, m := range got {
+			l := labels(m)
+			_, isInfo := l["player"]
+			if _, isState := l["state"]; isState {
+				isInfo = false
+			}
+			if stamped := m.TimestampMs != nil; stamped != isInfo {
+				t.Errorf("scrape %d: %v timestamped = %v, want %v", i, labels(m), stamped, isInfo)
+			}
+			if isInfo && time.Since(time.UnixMilli(m.GetTimestampMs())) > time.Minute {
+				t.Errorf("scrape %d: timestamp %d isn't the scrape's", i, m.GetTimestampMs())
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package sonos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (f *httpFetcher) fetchDevice(ctx context.Context, u *url.URL) (*Device, error) {
+	ctx, cancel := f.requestContext(ctx, u, f.stages.Device)
+	defer cancel()
+
+	// Time the TCP connect on its own, apart from the speaker's time to
+	// answer. A reused connection has nothing to time.
+	var connectStart time.Time
+	var connect time.Duration
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				connect = time.Since(connectStart)
+			}
+		},
+	})
+
+	resp, err := f.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var root struct {
+		Device Device `xml:"device"`
+	}
+	if err = f.newDecoder(resp.Body).Decode(&root); err != nil {
+		log.Printf("Decode %s: %s", resp.Request.URL, err)
+	}
+	root.Device.ConnectLatency = connect
+
+	return &root.Device, err
+}
+
+func (f *httpFetcher) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	f.limitBody(resp)
+
+	return resp, nil
+}
+
+// checkStatus returns an error for any response but 200 OK. Redirects
+// only get here when the client doesn't follow them, so say where they
+// point. After a followed redirect, resp.Request is the final request.
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		return fmt.Errorf("%s: %s to %s (redirects not followed)", resp.Request.URL, resp.Status, loc)
+	}
+
+	return fmt.Errorf("%s: %s", resp.Request.URL, resp.Status)
+}
+
+// requestContext bounds a single request to u, including reading its
+// body. The timeout is u's host's own if it has one, then the stage's,
+// then the collector's HTTP timeout. The request's DNS lookup, if it
+// needs one, is counted.
+func (f *httpFetcher) requestContext(ctx context.Context, u *url.URL, stage time.Duration) (context.Context, context.CancelFunc) {
+	timeout := f.timeout
+	if stage > 0 {
+		timeout = stage
+	}
+	if t, ok := f.timeouts[u.Host]; ok {
+		timeout = t
+	}
+
+	if f.dnsLookups != nil {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			DNSDone: func(info httptrace.DNSDoneInfo) {
+				countLookup(f.dnsLookups, f.dnsErrors, "forward", info.Err)
+			},
+		})
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+type Device struct {
+	DeviceType      string `xml:"deviceType"`
+	RoomName        string `xml:"roomName"`
+	DisplayVersion  string `xml:"displayVersion"`
+	HardwareVersion string `xml:"hardwareVersion"`
+	ModelName       string `xml:"modelName"`
+	ModelNumber     string `xml:"modelNumber"`
+	SerialNum       string `xml:"serialNum"`
+	SoftwareVersion string `xml:"softwareVersion"`
+	UDN             string `xml:"UDN"`
+	Invisible       string `xml:"invisible"`
+
+	Services []Service `xml:"serviceList>service"`
+	Devices  []Device  `xml:"deviceList>device"`
+
+	// HouseholdID isn't part of the device description; it's filled in
+	// from DeviceProperties when something needs it.
+	HouseholdID string `xml:"-"`
+
+	// ConnectLatency is how long the TCP connect took when fetching the
+	// description, or 0 if an open connection was reused.
+	ConnectLatency time.Duration `xml:"-"`
+}
+
+// Service is a UPnP service listed in a device description.
+type Service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+	SCPDURL     string `xml:"SCPDURL"`
+}
+
+// controlURL returns the control URL of service from d or its embedded
+// devices, falling back to the well known path when d is nil or doesn't
+// list it.
+func (d *Device) controlURL(service string) string {
+	if d != nil {
+		if u, ok := d.findControlURL(service); ok {
+			return u
+		}
+	}
+	return wellKnownControlPaths[service]
+}
+
+// eventSubURL returns the event subscription URL of service from d or its
+// embedded devices, falling back to the path Sonos firmware uses when d
+// is nil or doesn't list it.
+func (d *Device) eventSubURL(service string) string {
+	if d != nil {
+		if u, ok := d.findURL(service, func(s *Service) string { return s.EventSubURL }); ok {
+			return u
+		}
+	}
+	return eventPaths[service]
+}
+
+// speakerURL resolves ref, a URL from the device description of the
+// speaker at base, against base. Only ref's path and query are kept: a
+// description naming another host, by mistake or by a hostile device on
+// the network, still only gets requests sent to the speaker itself.
+func speakerURL(base *url.URL, ref string) (*url.URL, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(&url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}), nil
+}
+
+// hasService reports whether d or its embedded devices list service.
+func (d *Device) hasService(service string) bool {
+	_, ok := d.findControlURL(service)
+	return ok
+}
+
+func (d *Device) findControlURL(service string) (string, bool) {
+	return d.findURL(service, func(s *Service) string { return s.ControlURL })
+}
+
+// findURL returns the URL that field picks from service's entry in d or
+// its embedded devices, skipping entries that leave it empty.
+func (d *Device) findURL(service string, field func(*Service) string) (string, bool) {
+	for i := range d.Services {
+		s := &d.Services[i]
+		if u := field(s); s.ServiceType == service && u != "" {
+			return u, true
+		}
+	}
+	for i := range d.Devices {
+		if u, ok := d.Devices[i].findURL(service, field); ok {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// MACSerial returns d's serial number without its trailing ":A" style
+// disambiguator, leaving the MAC address it's based on.
+func (d *Device) MACSerial() string {
+	serial, _, _ := strings.Cut(d.SerialNum, ":")
+	return serial
+}
+
+// Generation returns "S1" or "S2" for the Sonos software generation d
+// runs, going by its display version: S1 stopped at 11.x and S2 started
+// at 12.0. It returns "unknown" if the version can't be parsed.
+func (d *Device) Generation() string {
+	major, _, _ := strings.Cut(strings.TrimSpace(d.DisplayVersion), ".")
+	n, err := strconv.Atoi(major)
+	switch {
+	case err != nil || n <= 0:
+		return "unknown"
+	case n < 12:
+		return "S1"
+	default:
+		return "S2"
+	}
+}
+
+// Visible reports whether d is a zone shown in the Sonos app. Devices
+// that don't say are assumed to be visible.
+func (d *Device) Visible() bool {
+	v, err := strconv.ParseBool(strings.TrimSpace(d.Invisible))
+	return err != nil || !v
+}
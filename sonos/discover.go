@@ -0,0 +1,405 @@
+package sonos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Discoverer finds the speakers to collect, returning the URL of each
+// one's device description.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// A Refresher can be made to discover speakers again right away,
+// instead of reusing a cached discovery.
+type Refresher interface {
+	Refresh(ctx context.Context) ([]string, error)
+}
+
+// ssdpDiscoverer finds ZonePlayers with an SSDP search. If allow is
+// set, responses whose USN isn't for an allowed UDN are dropped before
+// their Location is ever fetched. backoff is the first wait after a
+// transient read error, or defaultSSDPBackoff if zero. ttl is the
+// multicast TTL, or the OS default if zero. quiet leaves out the routine
+// log lines of each search, transient read errors among them.
+type ssdpDiscoverer struct {
+	allow   map[string]bool
+	backoff time.Duration
+	ttl     int
+	quiet   bool
+
+	// locations, if set, is updated with the number of unique locations
+	// each search finds.
+	locations prometheus.Gauge
+
+	// filtered, if set, counts the responses dropped by allow.
+	filtered prometheus.Counter
+
+	// latency, if set, observes how long each location's first response
+	// took, labeled by the address it came from.
+	latency *prometheus.HistogramVec
+}
+
+func (d ssdpDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	backoff := d.backoff
+	if backoff <= 0 {
+		backoff = defaultSSDPBackoff
+	}
+
+	found, err := searchWithBackoff(ctx, "urn:schemas-upnp-org:device:ZonePlayer:1", backoff, d.ttl, d.quiet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Speakers may answer a search more than once, so keep only the first
+	// response for each location.
+	seen := make(map[string]bool)
+	locs := make([]string, 0, len(found))
+	for _, r := range found {
+		dev := r.header
+		loc := dev.Get("Location")
+		if seen[loc] {
+			continue
+		}
+		seen[loc] = true
+
+		if d.latency != nil {
+			d.latency.WithLabelValues(r.ip).Observe(r.latency.Seconds())
+		}
+
+		if d.allow != nil && !d.allow[usnUDN(dev.Get("USN"))] {
+			if !d.quiet {
+				log.Printf("Skipping %s: USN %q not allowed", loc, dev.Get("USN"))
+			}
+			if d.filtered != nil {
+				d.filtered.Inc()
+			}
+			continue
+		}
+		locs = append(locs, loc)
+	}
+
+	if !d.quiet {
+		log.Printf("SSDP found %d responses at %d unique locations", len(found), len(seen))
+	}
+	if d.locations != nil {
+		d.locations.Set(float64(len(seen)))
+	}
+
+	return locs, nil
+}
+
+// usnUDN returns the UDN from an SSDP USN, which is the UDN followed by
+// "::" and the search target, without its "uuid:" prefix.
+func usnUDN(usn string) string {
+	udn, _, _ := strings.Cut(usn, "::")
+	return normalizeUDN(udn)
+}
+
+// normalizeUDN strips the optional "uuid:" prefix from udn, so that
+// allowlists can be written either way.
+func normalizeUDN(udn string) string {
+	return strings.TrimPrefix(strings.TrimSpace(udn), "uuid:")
+}
+
+// staticDiscoverer always returns the same locations.
+type staticDiscoverer []string
+
+func (d staticDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	return d, nil
+}
+
+// seedDiscoverer finds speakers by asking seed speakers for their
+// household's zone group topology, which lists every speaker's location.
+// It works where multicast doesn't reach, without listing every speaker.
+// The topology fetches hold the collector's concurrency slots like any
+// other fetch.
+type seedDiscoverer struct {
+	seeds []string
+	c     *collector
+}
+
+func (s *seedDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		groups []ZoneGroup
+		errs   []string
+	)
+	wg.Add(len(s.seeds))
+
+	for _, seed := range s.seeds {
+		go func(seed string) {
+			defer wg.Done()
+
+			g, err := s.fetch(ctx, seed)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", seed, err))
+				return
+			}
+			groups = append(groups, g...)
+		}(seed)
+	}
+
+	wg.Wait()
+
+	if len(errs) == len(s.seeds) {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		log.Printf("Seed %s", err)
+	}
+
+	seen := make(map[string]bool)
+	var locs []string
+	add := func(m ZoneGroupMember) {
+		if m.Location != "" && !seen[m.Location] {
+			seen[m.Location] = true
+			locs = append(locs, m.Location)
+		}
+	}
+	for _, g := range groups {
+		for _, m := range g.Members {
+			add(m)
+			for _, sat := range m.Satellites {
+				add(sat)
+			}
+		}
+	}
+
+	return locs, nil
+}
+
+func (s *seedDiscoverer) fetch(ctx context.Context, seed string) ([]ZoneGroup, error) {
+	if !s.c.acquire(ctx) {
+		return nil, ctx.Err()
+	}
+	defer s.c.release()
+
+	base, err := url.Parse(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.c.fetcher.fetchZoneGroups(ctx, base, nil)
+}
+
+// mergedDiscoverer combines the locations found by several
+// Discoverers, keeping only the first for each host. If one fails, the
+// others' locations are still returned.
+type mergedDiscoverer []Discoverer
+
+func (m mergedDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	var (
+		locs  []string
+		hosts = make(map[string]bool)
+		errs  []string
+	)
+
+	for _, d := range m {
+		found, err := d.Discover(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		for _, loc := range found {
+			if host := targetHost(loc); !hosts[host] {
+				hosts[host] = true
+				locs = append(locs, loc)
+			}
+		}
+	}
+
+	if len(errs) == len(m) {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		log.Printf("Discover: %s", err)
+	}
+
+	return locs, nil
+}
+
+// cachingDiscoverer reuses another Discoverer's results until they're
+// older than the TTL, scaled by a random factor within the jitter
+// fraction so exporters started together don't rediscover in lockstep.
+type cachingDiscoverer struct {
+	d      Discoverer
+	ttl    time.Duration
+	jitter float64
+
+	mu        sync.Mutex
+	locs      []string
+	refreshed time.Time
+	expires   time.Time
+}
+
+// cacheState is how a discovery went with the cache.
+type cacheState struct {
+	// hit is whether the discovery returned the cached locations.
+	hit bool
+
+	// refreshed is when the cached locations were discovered, zero if
+	// nothing is cached.
+	refreshed time.Time
+}
+
+func (c *cachingDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	locs, _, err := c.discover(ctx)
+	return locs, err
+}
+
+// discover is Discover, also returning how it went with the cache. The
+// state comes back from the call, rather than being kept for asking
+// about afterwards, as scrapes and refreshes can discover concurrently.
+func (c *cachingDiscoverer) discover(ctx context.Context) ([]string, cacheState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.locs != nil && time.Now().Before(c.expires) {
+		return c.locs, cacheState{hit: true, refreshed: c.refreshed}, nil
+	}
+
+	locs, err := c.d.Discover(ctx)
+	if err != nil {
+		return nil, cacheState{}, err
+	}
+
+	// Don't hold on to an empty result: finding nothing is more likely a
+	// lost multicast than a household with no speakers.
+	if len(locs) == 0 {
+		c.locs = nil
+		return locs, cacheState{}, nil
+	}
+
+	scale := 1 + c.jitter*(2*rand.Float64()-1)
+	c.locs = locs
+	c.refreshed = time.Now()
+	c.expires = c.refreshed.Add(time.Duration(float64(c.ttl) * scale))
+
+	return locs, cacheState{refreshed: c.refreshed}, nil
+}
+
+// discoveryModes are the modes sonos_discovery_mode always reports, 1
+// for the one in use and 0 for the rest.
+var discoveryModes = []string{"ssdp", "static", "both", "seed"}
+
+// discoveryMode names how d finds speakers, for sonos_discovery_mode.
+func discoveryMode(d Discoverer) string {
+	switch d := d.(type) {
+	case *cachingDiscoverer:
+		return discoveryMode(d.d)
+	case ssdpDiscoverer:
+		return "ssdp"
+	case staticDiscoverer:
+		return "static"
+	case mergedDiscoverer:
+		return "both"
+	case *seedDiscoverer:
+		return "seed"
+	case *fakeFetcher:
+		return "fake"
+	default:
+		return "custom"
+	}
+}
+
+// target is a parsed entry from the targets passed to NewCollector.
+type target struct {
+	loc     string
+	timeout time.Duration
+}
+
+// parseTarget parses a target spec: a host[:port] or URL, then any
+// number of ";name=value" options. The only option is timeout. A
+// malformed option is returned as an error alongside a target that
+// leaves it out.
+func parseTarget(spec string) (target, error) {
+	parts := strings.Split(spec, ";")
+	t := target{loc: targetLocation(strings.TrimSpace(parts[0]))}
+
+	var bad []string
+	for _, opt := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch name {
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				bad = append(bad, opt)
+				continue
+			}
+			t.timeout = d
+		default:
+			bad = append(bad, opt)
+		}
+	}
+
+	if len(bad) > 0 {
+		return t, fmt.Errorf("ignoring bad options %q", bad)
+	}
+	return t, nil
+}
+
+// CheckTarget returns an error if spec, a target as passed to
+// NewCollector, is malformed or its host name doesn't resolve.
+// NewCollector itself tolerates both, logging malformed options and
+// reporting targets it can't reach as down.
+func CheckTarget(ctx context.Context, spec string) error {
+	t, err := parseTarget(spec)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(t.loc)
+	if err != nil {
+		return err
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("no host in %q", t.loc)
+	}
+
+	if net.ParseIP(u.Hostname()) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// invalidate drops the cached locations, so the next Discover runs the
+// wrapped Discoverer.
+func (c *cachingDiscoverer) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.locs = nil
+}
+
+// targetLocation returns the device description URL for target. A bare
+// host gets the default Sonos port and description path.
+func targetLocation(target string) string {
+	if strings.Contains(target, "://") {
+		return target
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "1400")
+	}
+
+	return "http://" + target + "/xml/device_description.xml"
+}
@@ -0,0 +1,107 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollect_SeedsConcurrency(t *testing.T) {
+	const speakers, limit = 6, 2
+
+	var inFlight, most atomic.Int32
+	counted := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+
+			// Linger, so requests that aren't held back overlap.
+			time.Sleep(10 * time.Millisecond)
+			h(w, r)
+		}
+	}
+
+	// Every speaker's topology lists all of them, so the seeds are
+	// fetched in parallel and then every speaker is.
+	var members strings.Builder
+	topology := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(zoneGroupStateResponse(`<ZoneGroupState><ZoneGroups><ZoneGroup Coordinator="RINCON_0" ID="RINCON_0:1">` +
+			members.String() + `</ZoneGroup></ZoneGroups></ZoneGroupState>`)))
+	}
+
+	var targets []string
+	for i := 0; i < speakers; i++ {
+		target := newSpeaker(t, map[string]http.HandlerFunc{
+			"/xml/device_description.xml": counted(serve(deviceDescription)),
+			"/status/ifconfig":            counted(serve(ifconfigResponse(ifconfigSample))),
+			"/ZoneGroupTopology/Control":  counted(topology),
+		})
+		targets = append(targets, target)
+		fmt.Fprintf(&members, `<ZoneGroupMember UUID="RINCON_%d" Location="%s" ZoneName="Room %d"/>`, i, targetLocation(target), i)
+	}
+
+	metrics := gather(t, NewCollector(nil, WithSeeds(targets...), WithMaxConcurrency(limit)))
+
+	if got := len(metrics["sonos_up"]); got != speakers {
+		t.Errorf("got %d sonos_up, want %d", got, speakers)
+	}
+	if got := most.Load(); got > limit {
+		t.Errorf("%d requests at once, want at most %d", got, limit)
+	}
+}
+
+func TestCachingDiscoverer(t *testing.T) {
+	d := &cachingDiscoverer{d: staticDiscoverer{"http://192.168.1.20:1400/xml/device_description.xml"}, ttl: time.Minute}
+
+	for i, want := range []bool{false, true, true} {
+		locs, cache, err := d.discover(context.Background())
+		if err != nil {
+			t.Fatalf("discover %d: %s", i, err)
+		}
+		if len(locs) != 1 || cache.hit != want || cache.refreshed.IsZero() {
+			t.Errorf("discover %d: got %v, %+v; want one location, hit = %v", i, locs, cache, want)
+		}
+	}
+
+	d.invalidate()
+	if _, cache, _ := d.discover(context.Background()); cache.hit {
+		t.Errorf("got a hit after invalidate")
+	}
+}
+
+// failingDiscoverer is a Discoverer whose searches always fail.
+type failingDiscoverer struct{}
+
+func (failingDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	return nil, errors.New("no route to host")
+}
+
+func TestCollect_SearchFails(t *testing.T) {
+	var got []CollectError
+	c := NewCollector(nil, WithDiscoverer(failingDiscoverer{}), WithErrorHandler(func(e CollectError) {
+		got = append(got, e)
+	}))
+
+	metrics := gather(t, c)
+
+	if len(got) != 1 || got[0].Target != "" || got[0].Stage != "search" {
+		t.Errorf("got errors %v, want one at stage search", got)
+	}
+	var counted bool
+	for _, m := range metrics["sonos_collection_errors_total"] {
+		l := labels(m)
+		if l["target"] == "" && l["stage"] == "search" && value(m) == 1 {
+			counted = true
+		}
+	}
+	if !counted {
+		t.Errorf("no sonos_collection_errors_total for stage search")
+	}
+}
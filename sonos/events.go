@@ -0,0 +1,383 @@
+package sonos
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventPaths are where Sonos firmware takes GENA subscriptions for the
+// services whose events are kept, by service type. They're used when the
+// device description doesn't give a service's eventSubURL.
+var eventPaths = map[string]string{
+	avTransportService:      "/MediaRenderer/AVTransport/Event",
+	renderingControlService: "/MediaRenderer/RenderingControl/Event",
+}
+
+// eventTimeout is the subscription lifetime asked for. Subscriptions are
+// renewed on the first scrape after half of it has passed.
+const eventTimeout = 30 * time.Minute
+
+// subscription is a GENA subscription to one service of one speaker.
+type subscription struct {
+	host    string
+	sid     string
+	expires time.Time
+	renewed time.Time
+}
+
+// eventState is the latest state events have reported for a speaker.
+type eventState struct {
+	transport string
+	volume    float64
+	hasVolume bool
+	mute      bool
+	hasMute   bool
+}
+
+// eventSubscriber subscribes to speakers' AVTransport and
+// RenderingControl events and keeps the state they report, serving the
+// speakers' NOTIFY callbacks on a listener of its own. Speakers push
+// changes as they happen, so scrapes see them without polling.
+type eventSubscriber struct {
+	listener net.Listener
+	received prometheus.Counter
+
+	mu     sync.Mutex
+	subs   map[[2]string]*subscription // by host and service
+	bySID  map[string]*subscription
+	states map[string]*eventState // by host
+}
+
+func newEventSubscriber(l net.Listener) *eventSubscriber {
+	return &eventSubscriber{
+		listener: l,
+		received: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "sonos_events_received_total",
+				Help: "UPnP event notifications received from speakers",
+			},
+		),
+		subs:   make(map[[2]string]*subscription),
+		bySID:  make(map[string]*subscription),
+		states: make(map[string]*eventState),
+	}
+}
+
+// serve answers the speakers' NOTIFY requests until the listener is
+// closed.
+func (e *eventSubscriber) serve() {
+	if err := http.Serve(e.listener, e); err != nil {
+		log.Printf("Event listener %s: %s", e.listener.Addr(), err)
+	}
+}
+
+// ServeHTTP handles a NOTIFY from a speaker, decoding the LastChange
+// event it carries into the speaker's state.
+func (e *eventSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "NOTIFY" {
+		http.Error(w, "NOTIFY only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	e.mu.Lock()
+	sub, ok := e.bySID[r.Header.Get("SID")]
+	e.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+
+	var props struct {
+		Properties []struct {
+			LastChange string `xml:"LastChange"`
+		} `xml:"property"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, DefaultMaxResponseBytes)).Decode(&props); err != nil {
+		log.Printf("Event from %s: %s", sub.host, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.received.Inc()
+
+	for _, p := range props.Properties {
+		if p.LastChange == "" {
+			continue
+		}
+		if err := e.applyLastChange(sub.host, p.LastChange); err != nil {
+			log.Printf("Event from %s: LastChange: %s", sub.host, err)
+		}
+	}
+}
+
+// applyLastChange updates host's state from a LastChange document, which
+// lists the state variables changed on each instance:
+//
+//	<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/">
+//	  <InstanceID val="0"><TransportState val="PLAYING"/></InstanceID>
+//	</Event>
+func (e *eventSubscriber) applyLastChange(host, doc string) error {
+	var ev struct {
+		Instance struct {
+			TransportState *struct {
+				Val string `xml:"val,attr"`
+			} `xml:"TransportState"`
+			Volume []struct {
+				Channel string `xml:"channel,attr"`
+				Val     string `xml:"val,attr"`
+			} `xml:"Volume"`
+			Mute []struct {
+				Channel string `xml:"channel,attr"`
+				Val     string `xml:"val,attr"`
+			} `xml:"Mute"`
+		} `xml:"InstanceID"`
+	}
+	if err := xml.Unmarshal([]byte(doc), &ev); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.states[host]
+	if !ok {
+		s = &eventState{}
+		e.states[host] = s
+	}
+
+	if ts := ev.Instance.TransportState; ts != nil {
+		s.transport = ts.Val
+	}
+	for _, v := range ev.Instance.Volume {
+		if v.Channel != "Master" {
+			continue
+		}
+		if n, err := strconv.ParseFloat(v.Val, 64); err == nil {
+			s.volume, s.hasVolume = n, true
+		}
+	}
+	for _, m := range ev.Instance.Mute {
+		if m.Channel == "Master" {
+			s.mute, s.hasMute = upnpBool(m.Val), true
+		}
+	}
+
+	return nil
+}
+
+// ensure subscribes to each service's events on the speaker at base, or
+// renews the subscription once half its lifetime has passed. A renewal
+// the speaker refuses, as after a reboot, is replaced by a new
+// subscription. The event subscription URLs come from d.
+func (e *eventSubscriber) ensure(ctx context.Context, f *httpFetcher, base *url.URL, d *Device) error {
+	for service := range eventPaths {
+		key := [2]string{base.Host, service}
+
+		now := time.Now()
+
+		e.mu.Lock()
+		sub := e.subs[key]
+		fresh := sub != nil && now.Sub(sub.renewed) < eventTimeout/2 && now.Before(sub.expires)
+		var sid string
+		if sub != nil {
+			sid = sub.sid
+		}
+		e.mu.Unlock()
+
+		if fresh {
+			continue
+		}
+
+		u, err := speakerURL(base, d.eventSubURL(service))
+		if err != nil {
+			return fmt.Errorf("subscribe %s: %w", service, err)
+		}
+
+		if sid != "" {
+			if _, timeout, err := e.subscribe(ctx, f, u, sid); err == nil {
+				e.mu.Lock()
+				sub.renewed, sub.expires = now, now.Add(timeout)
+				e.mu.Unlock()
+				continue
+			}
+			e.drop(key, sub)
+		}
+
+		sid, timeout, err := e.subscribe(ctx, f, u, "")
+		if err != nil {
+			// Without a subscription, what events reported last
+			// goes stale unnoticed; leave it to polling instead.
+			e.forget(base.Host)
+			return fmt.Errorf("subscribe %s: %w", service, err)
+		}
+
+		sub = &subscription{host: base.Host, sid: sid, renewed: now, expires: now.Add(timeout)}
+		e.mu.Lock()
+		e.subs[key] = sub
+		e.bySID[sid] = sub
+		e.mu.Unlock()
+	}
+
+	return nil
+}
+
+// drop forgets sub, which is key's, and the state its events reported.
+func (e *eventSubscriber) drop(key [2]string, sub *subscription) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.subs, key)
+	delete(e.bySID, sub.sid)
+	delete(e.states, sub.host)
+}
+
+// forget drops the state events reported for host, so scrapes poll for
+// it until events arrive again.
+func (e *eventSubscriber) forget(host string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.states, host)
+}
+
+// subscribe sends a GENA SUBSCRIBE for u, renewing the subscription sid
+// if it's set and otherwise starting a new one. It returns the
+// subscription's SID and how long the speaker will keep it.
+func (e *eventSubscriber) subscribe(ctx context.Context, f *httpFetcher, u *url.URL, sid string) (string, time.Duration, error) {
+	ctx, cancel := f.requestContext(ctx, u, f.stages.SOAP)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "SUBSCRIBE", u.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if sid != "" {
+		req.Header.Set("SID", sid)
+	} else {
+		callback, err := e.callbackURL(u)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("CALLBACK", "<"+callback+">")
+		req.Header.Set("NT", "upnp:event")
+	}
+	req.Header.Set("TIMEOUT", fmt.Sprintf("Second-%d", int(eventTimeout.Seconds())))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return "", 0, err
+	}
+
+	if s := resp.Header.Get("SID"); s != "" {
+		sid = s
+	}
+	if sid == "" {
+		return "", 0, fmt.Errorf("%s: no SID in response", u)
+	}
+
+	timeout := eventTimeout
+	if s := resp.Header.Get("TIMEOUT"); strings.HasPrefix(s, "Second-") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(s, "Second-")); err == nil {
+			timeout = time.Duration(n) * time.Second
+		}
+	}
+
+	return sid, timeout, nil
+}
+
+// callbackURL returns the URL the speaker at u should send its events
+// to: the listener's port on whichever local address routes to it.
+func (e *eventSubscriber) callbackURL(u *url.URL) (string, error) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	// Dialing UDP sends nothing; it only picks the local address.
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	_, lport, err := net.SplitHostPort(e.listener.Addr().String())
+	if err != nil {
+		return "", err
+	}
+
+	return "http://" + net.JoinHostPort(local.IP.String(), lport) + "/", nil
+}
+
+// state returns a copy of host's state from events, if any have arrived.
+func (e *eventSubscriber) state(host string) (eventState, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, ok := e.states[host]
+	if !ok {
+		return eventState{}, false
+	}
+	return *s, true
+}
+
+// collectEvents keeps the speaker at base, described by d, subscribed to
+// events. The state they report is emitted by collectRendering and
+// collectTransport, in place of asking for it.
+func (c *collector) collectEvents(ctx context.Context, base *url.URL, d *Device) {
+	f, ok := c.fetcher.(*httpFetcher)
+	if !ok {
+		return
+	}
+
+	if err := c.events.ensure(ctx, f, base, d); err != nil {
+		log.Printf("Events %s: %s", base, err)
+		c.fail(base.Host, "events", err)
+	}
+}
+
+// eventTransport returns the transport state events last reported for
+// the speaker at base, if eventing is on and any has arrived.
+func (c *collector) eventTransport(base *url.URL) (string, bool) {
+	if c.events == nil {
+		return "", false
+	}
+	s, ok := c.events.state(base.Host)
+	return s.transport, ok && s.transport != ""
+}
+
+// eventVolume returns the volume events last reported for the speaker at
+// base, if eventing is on and any has arrived.
+func (c *collector) eventVolume(base *url.URL) (float64, bool) {
+	if c.events == nil {
+		return 0, false
+	}
+	s, ok := c.events.state(base.Host)
+	return s.volume, ok && s.hasVolume
+}
+
+// eventMute returns whether events last reported the speaker at base
+// muted, if eventing is on and any has arrived.
+func (c *collector) eventMute(base *url.URL) (bool, bool) {
+	if c.events == nil {
+		return false, false
+	}
+	s, ok := c.events.state(base.Host)
+	return s.mute, ok && s.hasMute
+}
@@ -0,0 +1,92 @@
+package sonos
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventsDescription is a device description listing its services' event
+// subscription URLs somewhere other than the usual paths.
+const eventsDescription = `<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+  <roomName>Kitchen</roomName>
+  <deviceList><device>
+    <serviceList>
+      <service><serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType><eventSubURL>/events/AVTransport</eventSubURL></service>
+      <service><serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType><eventSubURL>http://192.0.2.1/events/RenderingControl</eventSubURL></service>
+    </serviceList>
+  </device></deviceList>
+</device></root>`
+
+func TestEventSubscriber_Ensure(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		paths   []string
+		refused bool
+	)
+	subscribe := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method != "SUBSCRIBE" || refused {
+			http.Error(w, "refused", http.StatusPreconditionFailed)
+			return
+		}
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("SID", "uuid:"+r.URL.Path)
+		w.Header().Set("TIMEOUT", "Second-1800")
+	}
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(eventsDescription),
+		"/events/AVTransport":         subscribe,
+		"/events/RenderingControl":    subscribe,
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c := NewCollector(nil, WithEventing(l)).(*collector)
+	f := c.fetcher.(*httpFetcher)
+	base := &url.URL{Scheme: "http", Host: target}
+
+	d, err := f.fetchDevice(context.Background(), base.JoinPath("/xml/device_description.xml"))
+	if err != nil {
+		t.Fatalf("fetchDevice: %s", err)
+	}
+
+	// The description's eventSubURLs are used, on the speaker itself
+	// even when they name another host.
+	if err := c.events.ensure(context.Background(), f, base, d); err != nil {
+		t.Fatalf("ensure: %s", err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("subscribed at %v, want both /events paths", paths)
+	}
+
+	// Events reported a volume, but then the speaker refuses to renew
+	// or subscribe again, as when it's reset. The volume is forgotten,
+	// rather than reported as current.
+	if err := c.events.applyLastChange(target, `<Event><InstanceID val="0"><Volume channel="Master" val="23"/></InstanceID></Event>`); err != nil {
+		t.Fatalf("applyLastChange: %s", err)
+	}
+	mu.Lock()
+	refused = true
+	mu.Unlock()
+	for _, sub := range c.events.subs {
+		sub.renewed = time.Now().Add(-eventTimeout)
+	}
+
+	if err := c.events.ensure(context.Background(), f, base, d); err == nil {
+		t.Errorf("ensure with subscriptions refused: got no error")
+	}
+	if _, ok := c.events.state(target); ok {
+		t.Errorf("kept the state events reported after the subscription was lost")
+	}
+}
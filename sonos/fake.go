@@ -0,0 +1,308 @@
+package sonos
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var fakeModels = []struct {
+	name, number string
+	services     []Service
+}{
+	{"Sonos One", "S18", nil},
+	{"Sonos Five", "S26", nil},
+	{"Sonos Arc", "S19", []Service{{
+		ServiceType: htControlService,
+		ControlURL:  "/HTControl/Control",
+		SCPDURL:     "/xml/HTControl1.xml",
+	}}},
+	{"Sonos Move", "S17", nil},
+}
+
+// fakeFetcher serves n made up speakers at fake-1 through fake-n. It's
+// both their Discoverer and their fetcher. Each fetch of a speaker's
+// ifconfig advances its counters by a random amount.
+type fakeFetcher struct {
+	n int
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	ifaces  map[string]map[string]stats
+	volumes map[string]float64
+}
+
+func newFakeFetcher(n int) *fakeFetcher {
+	return &fakeFetcher{
+		n:       n,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		ifaces:  make(map[string]map[string]stats),
+		volumes: make(map[string]float64),
+	}
+}
+
+func (f *fakeFetcher) Discover(ctx context.Context) ([]string, error) {
+	locs := make([]string, f.n)
+	for i := range locs {
+		locs[i] = targetLocation(fmt.Sprintf("fake-%d", i+1))
+	}
+	return locs, nil
+}
+
+// index returns which fake speaker base refers to, counting from 0.
+func (f *fakeFetcher) index(base *url.URL) (int, error) {
+	i, err := strconv.Atoi(strings.TrimPrefix(base.Hostname(), "fake-"))
+	if err != nil || i < 1 || i > f.n {
+		return 0, fmt.Errorf("%s: no such fake speaker", base.Host)
+	}
+	return i - 1, nil
+}
+
+func (f *fakeFetcher) fetchDevice(ctx context.Context, base *url.URL) (*Device, error) {
+	i, err := f.index(base)
+	if err != nil {
+		return nil, err
+	}
+
+	model := fakeModels[i%len(fakeModels)]
+
+	return &Device{
+		DeviceType:      "urn:schemas-upnp-org:device:ZonePlayer:1",
+		RoomName:        fmt.Sprintf("Fake Room %d", i+1),
+		DisplayVersion:  "15.9",
+		HardwareVersion: "1.20.1.6-2",
+		ModelName:       model.name,
+		ModelNumber:     model.number,
+		SerialNum:       fmt.Sprintf("00-00-5E-00-53-%02X:A", i),
+		SoftwareVersion: "74.0-43050",
+		UDN:             fmt.Sprintf("uuid:RINCON_00005E0053%02X01400", i),
+		Services:        model.services,
+	}, nil
+}
+
+func (f *fakeFetcher) fetchIfconfig(ctx context.Context, base *url.URL) (map[string]stats, error) {
+	if _, err := f.index(base); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ifaces, ok := f.ifaces[base.Host]
+	if !ok {
+		i, _ := f.index(base)
+		ifaces = map[string]stats{
+			"lo":   {txQueueLen: 0, up: true, ipv6: "::1", mtu: 16436},
+			"eth0": {txQueueLen: 1000, up: true, ipv4: fmt.Sprintf("192.0.2.%d", i+1), hasRxBacklog: true, hasTxBacklog: true, speed: 100e6, mtu: 1500},
+			"ath0": {txQueueLen: 1000, mtu: 1500},
+		}
+		f.ifaces[base.Host] = ifaces
+	}
+
+	ret := make(map[string]stats, len(ifaces))
+	for name, s := range ifaces {
+		rx := float64(f.rand.Intn(1 << 20))
+		tx := float64(f.rand.Intn(1 << 18))
+
+		s.fieldsParsed = len(defaultIfconfigRegexps)
+		s.rxBytes += rx
+		s.rxPackets += math.Ceil(rx / 1000)
+		s.txBytes += tx
+		s.txPackets += math.Ceil(tx / 500)
+		if f.rand.Intn(100) == 0 {
+			s.collisions++
+		}
+		if s.hasTxBacklog {
+			s.txBacklog = float64(f.rand.Intn(20))
+		}
+
+		ifaces[name] = s
+		ret[name] = s
+	}
+
+	return ret, nil
+}
+
+func (f *fakeFetcher) fetchLocalInfo(ctx context.Context, base *url.URL) (*LocalInfo, error) {
+	i, err := f.index(base)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &LocalInfo{
+		HouseholdID: "Sonos_fake",
+		PlayerID:    fmt.Sprintf("RINCON_00005E0053%02X01400", i),
+	}
+	info.GroupID = info.PlayerID + ":1"
+	info.Device.ID = info.PlayerID
+	info.Device.Name = fmt.Sprintf("Fake Room %d", i+1)
+	info.Device.SWGen = 2
+
+	return info, nil
+}
+
+// fetchLocalVolume answers as fetchVolume and fetchMute do.
+func (f *fakeFetcher) fetchLocalVolume(ctx context.Context, base *url.URL, playerID string) (*LocalVolume, error) {
+	v, err := f.fetchVolume(ctx, base, nil)
+	if err != nil {
+		return nil, err
+	}
+	muted, err := f.fetchMute(ctx, base, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalVolume{Volume: v, Muted: muted}, nil
+}
+
+// fetchLocalPlayback has each speaker's group playing most of the time,
+// like fetchTransportState.
+func (f *fakeFetcher) fetchLocalPlayback(ctx context.Context, base *url.URL, groupID string) (*LocalPlayback, error) {
+	if _, err := f.index(base); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &LocalPlayback{PlaybackState: fakePlaybackStates[f.rand.Intn(len(fakePlaybackStates))]}, nil
+}
+
+var fakePlaybackStates = []string{"PLAYBACK_STATE_PLAYING", "PLAYBACK_STATE_PLAYING", "PLAYBACK_STATE_PLAYING", "PLAYBACK_STATE_PAUSED", "PLAYBACK_STATE_IDLE"}
+
+// fetchActions counts the actions of HTControl, the only service fake
+// speakers list.
+func (f *fakeFetcher) fetchActions(ctx context.Context, base *url.URL, scpdURL string) (int, error) {
+	if _, err := f.index(base); err != nil {
+		return 0, err
+	}
+	return 6, nil
+}
+
+// fetchHTAudioIn has the TV sending stereo PCM (format 21) half the
+// time.
+func (f *fakeFetcher) fetchHTAudioIn(ctx context.Context, base *url.URL, d *Device) (int, error) {
+	if _, err := f.index(base); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rand.Intn(2) == 0 {
+		return 0, nil
+	}
+	return 21, nil
+}
+
+// fetchOutputFixed reports fixed output as unsupported, since none of
+// the fake models has a line-out.
+func (f *fakeFetcher) fetchOutputFixed(ctx context.Context, base *url.URL, d *Device) (bool, bool, error) {
+	if _, err := f.index(base); err != nil {
+		return false, false, err
+	}
+	return false, false, nil
+}
+
+// fetchVolume drifts each speaker's volume a step at a time, starting
+// from 20.
+func (f *fakeFetcher) fetchVolume(ctx context.Context, base *url.URL, d *Device) (float64, error) {
+	if _, err := f.index(base); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.volumes[base.Host]
+	if !ok {
+		v = 20
+	}
+	v += float64(f.rand.Intn(3) - 1)
+	v = math.Max(0, math.Min(100, v))
+	f.volumes[base.Host] = v
+
+	return v, nil
+}
+
+// fetchMute has each speaker muted one time in twenty.
+func (f *fakeFetcher) fetchMute(ctx context.Context, base *url.URL, d *Device) (bool, error) {
+	if _, err := f.index(base); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rand.Intn(20) == 0, nil
+}
+
+// fetchTransportState has each speaker playing most of the time.
+func (f *fakeFetcher) fetchTransportState(ctx context.Context, base *url.URL, d *Device) (string, error) {
+	if _, err := f.index(base); err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return fakeTransportStates[f.rand.Intn(len(fakeTransportStates))], nil
+}
+
+var fakeTransportStates = []string{"PLAYING", "PLAYING", "PLAYING", "PAUSED_PLAYBACK", "STOPPED"}
+
+func (f *fakeFetcher) fetchTime(ctx context.Context, base *url.URL, d *Device) (time.Duration, error) {
+	if _, err := f.index(base); err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return time.Duration(f.rand.Intn(2000)-1000) * time.Millisecond, nil
+}
+
+func (f *fakeFetcher) fetchHouseholdID(ctx context.Context, base *url.URL, d *Device) (string, error) {
+	if _, err := f.index(base); err != nil {
+		return "", err
+	}
+	return "Sonos_fake", nil
+}
+
+func (f *fakeFetcher) fetchAlarms(ctx context.Context, base *url.URL, d *Device) ([]Alarm, error) {
+	return []Alarm{
+		{ID: "1", StartTime: "07:00:00", Recurrence: "WEEKDAYS", Enabled: "1", RoomUUID: "RINCON_00005E00530001400"},
+		{ID: "2", StartTime: "09:00:00", Recurrence: "WEEKENDS", Enabled: "0", RoomUUID: "RINCON_00005E00530001400"},
+	}, nil
+}
+
+// fetchZoneGroups pairs up the fake speakers, each odd numbered one
+// coordinating a group with the next.
+func (f *fakeFetcher) fetchZoneGroups(ctx context.Context, base *url.URL, d *Device) ([]ZoneGroup, error) {
+	if _, err := f.index(base); err != nil {
+		return nil, err
+	}
+
+	var groups []ZoneGroup
+	for i := 0; i < f.n; i += 2 {
+		g := ZoneGroup{
+			ID:          fmt.Sprintf("RINCON_00005E0053%02X01400:1", i),
+			Coordinator: fmt.Sprintf("RINCON_00005E0053%02X01400", i),
+		}
+		for j := i; j < i+2 && j < f.n; j++ {
+			g.Members = append(g.Members, ZoneGroupMember{
+				UUID:     fmt.Sprintf("RINCON_00005E0053%02X01400", j),
+				Location: targetLocation(fmt.Sprintf("fake-%d", j+1)),
+				ZoneName: fmt.Sprintf("Fake Room %d", j+1),
+			})
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
@@ -0,0 +1,106 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fetcher retrieves everything the collector knows how to ask a speaker.
+// httpFetcher talks to real speakers; fakeFetcher makes data up.
+type fetcher interface {
+	fetchDevice(ctx context.Context, base *url.URL) (*Device, error)
+	fetchIfconfig(ctx context.Context, base *url.URL) (map[string]stats, error)
+	fetchLocalInfo(ctx context.Context, base *url.URL) (*LocalInfo, error)
+	fetchLocalVolume(ctx context.Context, base *url.URL, playerID string) (*LocalVolume, error)
+	fetchLocalPlayback(ctx context.Context, base *url.URL, groupID string) (*LocalPlayback, error)
+	fetchActions(ctx context.Context, base *url.URL, scpdURL string) (int, error)
+
+	// The rest are SOAP actions, which take the device description to
+	// find their control URLs. It may be nil when that isn't known.
+	fetchTime(ctx context.Context, base *url.URL, d *Device) (time.Duration, error)
+	fetchHouseholdID(ctx context.Context, base *url.URL, d *Device) (string, error)
+	fetchAlarms(ctx context.Context, base *url.URL, d *Device) ([]Alarm, error)
+	fetchZoneGroups(ctx context.Context, base *url.URL, d *Device) ([]ZoneGroup, error)
+	fetchHTAudioIn(ctx context.Context, base *url.URL, d *Device) (int, error)
+	fetchOutputFixed(ctx context.Context, base *url.URL, d *Device) (supported, fixed bool, err error)
+	fetchVolume(ctx context.Context, base *url.URL, d *Device) (float64, error)
+	fetchMute(ctx context.Context, base *url.URL, d *Device) (bool, error)
+	fetchTransportState(ctx context.Context, base *url.URL, d *Device) (string, error)
+}
+
+type httpFetcher struct {
+	client        *http.Client
+	transport     *http.Transport
+	timeout       time.Duration
+	timeouts      map[string]time.Duration
+	stages        StageTimeouts
+	regexps       map[string]*regexp.Regexp
+	parseDuration prometheus.Histogram
+	soapErrors    *prometheus.CounterVec
+	dnsLookups    *prometheus.CounterVec
+	dnsErrors     *prometheus.CounterVec
+	lenientXML    bool
+	localAPIKey   string
+
+	// maxResponse is the most bytes read from a response body, or
+	// unlimited if zero.
+	maxResponse int64
+}
+
+// errResponseTooLarge is returned reading a response body longer than
+// the limit set by WithMaxResponseBytes.
+var errResponseTooLarge = errors.New("response too large")
+
+// limitBody caps resp's body at f.maxResponse bytes. Reading past the
+// cap fails with errResponseTooLarge rather than truncating silently,
+// which could decode as a valid but incomplete document.
+func (f *httpFetcher) limitBody(resp *http.Response) {
+	if f.maxResponse > 0 {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, left: f.maxResponse, max: f.maxResponse}
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	left, max int64
+
+	// err is set once the body has gone over the limit, failing every
+	// read from then on.
+	err error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	// Allow one byte beyond the limit, to tell a body of exactly max
+	// bytes from a longer one.
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		// The byte beyond the limit isn't returned.
+		b.left = 0
+		b.err = fmt.Errorf("%w: over %d bytes", errResponseTooLarge, b.max)
+		return n - 1, b.err
+	}
+	return n, err
+}
+
+// closeIdleConnections closes the pooled connections to the speakers, so
+// the next request to each host name looks its address up again.
+func (f *httpFetcher) closeIdleConnections() {
+	f.transport.CloseIdleConnections()
+}
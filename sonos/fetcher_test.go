@@ -0,0 +1,95 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFetch_Redirect(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/moved/device_description.xml", http.StatusMovedPermanently)
+		},
+		"/moved/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/moved/ifconfig", http.StatusFound)
+		},
+		"/moved/ifconfig": serve(ifconfigResponse(ifconfigSample)),
+	})
+
+	ctx := context.Background()
+	base := &url.URL{Scheme: "http", Host: target}
+	desc := &url.URL{Scheme: "http", Host: target, Path: "/xml/device_description.xml"}
+
+	f := NewCollector(nil).(*collector).fetcher
+
+	d, err := f.fetchDevice(ctx, desc)
+	if err != nil {
+		t.Fatalf("fetchDevice: %s", err)
+	}
+	if d.RoomName != "Kitchen" {
+		t.Errorf("fetchDevice room = %q, want Kitchen", d.RoomName)
+	}
+
+	ifaces, err := f.fetchIfconfig(ctx, base)
+	if err != nil {
+		t.Fatalf("fetchIfconfig: %s", err)
+	}
+	if _, ok := ifaces["eth0"]; !ok {
+		t.Errorf("fetchIfconfig got %v, want eth0", ifaces)
+	}
+
+	// Not following redirects, both fail saying where they'd have gone.
+	noFollow := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	f = NewCollector(nil, WithHTTPClient(noFollow)).(*collector).fetcher
+
+	if _, err := f.fetchDevice(ctx, desc); err == nil || !strings.Contains(err.Error(), "/moved/device_description.xml") {
+		t.Errorf("fetchDevice not following redirects: got error %v, want one naming the new location", err)
+	}
+	if _, err := f.fetchIfconfig(ctx, base); err == nil || !strings.Contains(err.Error(), "/moved/ifconfig") {
+		t.Errorf("fetchIfconfig not following redirects: got error %v, want one naming the new location", err)
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	b := &limitedBody{ReadCloser: io.NopCloser(strings.NewReader("K\xfcche, over the limit")), left: 5, max: 5}
+
+	var got []byte
+	p := make([]byte, 4)
+	for i := 0; i < 5; i++ {
+		n, err := b.Read(p)
+		if n < 0 || n > len(p) {
+			t.Fatalf("read %d: n = %d", i, n)
+		}
+		got = append(got, p[:n]...)
+
+		// Once over the limit, every read fails.
+		if i >= 2 && !errors.Is(err, errResponseTooLarge) {
+			t.Errorf("read %d: got error %v, want errResponseTooLarge", i, err)
+		}
+	}
+	if string(got) != "K\xfcche" {
+		t.Errorf("read %q, want the first 5 bytes", got)
+	}
+}
+
+func TestFetchDevice_Latin1TooLarge(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(latin1Description),
+	})
+
+	f := NewCollector(nil, WithMaxResponseBytes(int64(len(latin1Description)/2))).(*collector).fetcher
+	_, err := f.fetchDevice(context.Background(), &url.URL{Scheme: "http", Host: target, Path: "/xml/device_description.xml"})
+	if !errors.Is(err, errResponseTooLarge) {
+		t.Errorf("fetchDevice: got error %v, want errResponseTooLarge", err)
+	}
+}
@@ -0,0 +1,302 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parserVersion identifies the ifconfig parsing logic, for
+// sonos_parser_version. Bump it whenever parsing changes, so that users
+// hit by firmware drift can tell whether a fixed exporter is running.
+const parserVersion = "5"
+
+// ifconfigPaths are where firmware serves the ifconfig output, in the
+// order to try them. Very old ZonePlayers only have the legacy /zp path.
+var ifconfigPaths = []string{"/status/ifconfig", "/zp/status/ifconfig"}
+
+func (f *httpFetcher) fetchIfconfig(ctx context.Context, base *url.URL) (map[string]stats, error) {
+	ctx, cancel := f.requestContext(ctx, base, f.stages.Ifconfig)
+	defer cancel()
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i, path := range ifconfigPaths {
+		u := *base
+		u.Path = path
+
+		resp, err = f.get(ctx, &u)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusNotFound || i == len(ifconfigPaths)-1 {
+			break
+		}
+		resp.Body.Close()
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var root struct {
+		Command string `xml:"Command"`
+	}
+	if err = f.newDecoder(resp.Body).Decode(&root); err != nil {
+		log.Printf("Decode %s: %s", resp.Request.URL, err)
+		if errors.Is(err, errResponseTooLarge) {
+			return nil, err
+		}
+	}
+
+	// root.Command is a blank line separated series of network interfaces:
+	//
+	// lo        Link encap:Local Loopback
+	//           inet addr:127.0.0.1  Mask:255.0.0.0
+	//           UP LOOPBACK RUNNING  MTU:16436  Metric:1
+	//           RX packets:1558 errors:0 dropped:0 overruns:0 frame:0
+	//           TX packets:1558 errors:0 dropped:0 overruns:0 carrier:0
+	//           collisions:0 txqueuelen:0
+	//           RX bytes:263284 (257.1 KiB)  TX bytes:263284 (257.1
+
+	// Some intermediaries rewrite the line endings to CRLF, which would
+	// break both the block split and the line anchored regexps.
+	command := strings.ReplaceAll(root.Command, "\r\n", "\n")
+
+	ret := make(map[string]stats)
+
+	for _, text := range strings.Split(command, "\n\n") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		start := time.Now()
+
+		var m []string
+		var s stats
+
+		m = f.regexps["rx_bytes"].FindStringSubmatch(text)
+		if len(m) > 1 {
+			s.rxBytes = atof(m[1])
+			s.fieldsParsed++
+		}
+
+		m = f.regexps["rx_packets"].FindStringSubmatch(text)
+		if len(m) > 1 {
+			s.rxPackets = atof(m[1])
+			s.fieldsParsed++
+		}
+
+		m = f.regexps["tx_bytes"].FindStringSubmatch(text)
+		if len(m) > 1 {
+			s.txBytes = atof(m[1])
+			s.fieldsParsed++
+		}
+
+		m = f.regexps["tx_packets"].FindStringSubmatch(text)
+		if len(m) > 1 {
+			s.txPackets = atof(m[1])
+			s.fieldsParsed++
+		}
+
+		m = f.regexps["collisions"].FindStringSubmatch(text)
+		if len(m) > 1 {
+			s.collisions = atof(m[1])
+			s.fieldsParsed++
+		}
+
+		m = f.regexps["txqueuelen"].FindStringSubmatch(text)
+		if len(m) > 1 {
+			s.txQueueLen = atof(m[1])
+			s.fieldsParsed++
+		}
+
+		s.up = ifaceUp(text)
+
+		// Either address may be missing: some firmware has no IPv4
+		// address on lo, and an interface that's down has neither.
+		if m := inetRe.FindStringSubmatch(text); len(m) > 1 {
+			s.ipv4 = m[1]
+		}
+		if m := inet6Re.FindStringSubmatch(text); len(m) > 1 {
+			s.ipv6 = m[1]
+		}
+
+		// Only some firmware reports the queue backlogs, as a line like
+		// "RX backlog:0  TX backlog:12" or "RX dropped (backlog):0".
+		if m := rxBacklogRe.FindStringSubmatch(text); len(m) > 1 {
+			s.rxBacklog, s.hasRxBacklog = atof(m[1]), true
+		}
+		if m := txBacklogRe.FindStringSubmatch(text); len(m) > 1 {
+			s.txBacklog, s.hasTxBacklog = atof(m[1]), true
+		}
+
+		// The MTU ends the flags line: "UP LOOPBACK RUNNING  MTU:16436".
+		if m := mtuRe.FindStringSubmatch(text); len(m) > 1 {
+			s.mtu = atof(m[1])
+		}
+
+		// Nor does most firmware report link speed, which is given as
+		// "Speed:100Mb/s" or the like when it is.
+		if m := speedRe.FindStringSubmatch(text); len(m) > 2 {
+			s.speed = atof(m[1]) * speedUnits[strings.ToLower(m[2])]
+		}
+
+		name := ifaceName(text)
+		if name != "" {
+			ret[name] = s
+		}
+
+		f.parseDuration.Observe(time.Since(start).Seconds())
+	}
+
+	return ret, err
+}
+
+// ifaceName returns the interface name from an ifconfig block: the first
+// word at column 0, preferring a line with "Link encap". Lines starting
+// with whitespace are continuations and never name an interface.
+func ifaceName(text string) string {
+	if m := ifaceLinkRe.FindStringSubmatch(text); len(m) > 1 {
+		return m[1]
+	}
+	if m := ifaceNameRe.FindStringSubmatch(text); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+// ifaceUp reports whether an ifconfig block's flags line, the one ending
+// in the MTU, includes both UP and RUNNING.
+func ifaceUp(text string) bool {
+	m := ifaceFlagsRe.FindStringSubmatch(text)
+	if len(m) < 2 {
+		return false
+	}
+
+	var up, running bool
+	for _, flag := range strings.Fields(m[1]) {
+		switch flag {
+		case "UP":
+			up = true
+		case "RUNNING":
+			running = true
+		}
+	}
+
+	return up && running
+}
+
+func atof(num string) float64 {
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// defaultIfconfigRegexps match each stat in the English ifconfig output,
+// keyed by the field names that WithIfconfigRegexps overrides.
+var defaultIfconfigRegexps = map[string]*regexp.Regexp{
+	"rx_bytes":   rxBytesRe,
+	"rx_packets": rxPacketsRe,
+	"tx_bytes":   txBytesRe,
+	"tx_packets": txPacketsRe,
+	"collisions": collisionsRe,
+	"txqueuelen": txQueueLenRe,
+}
+
+// CompileIfconfigRegexps compiles overrides for WithIfconfigRegexps,
+// checking that each is for a known field and has a submatch for the
+// field's value.
+func CompileIfconfigRegexps(overrides map[string]string) (map[string]*regexp.Regexp, error) {
+	ret := make(map[string]*regexp.Regexp)
+
+	for field, expr := range overrides {
+		if _, ok := defaultIfconfigRegexps[field]; !ok {
+			return nil, fmt.Errorf("unknown ifconfig field %q", field)
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("%s: %q has no submatch for the value", field, expr)
+		}
+
+		ret[field] = re
+	}
+
+	return ret, nil
+}
+
+type stats struct {
+	rxBytes   float64
+	rxPackets float64
+	txBytes   float64
+	txPackets float64
+
+	collisions float64
+	txQueueLen float64
+
+	// The backlogs are only set if has is, since few firmware versions
+	// report them.
+	rxBacklog, txBacklog       float64
+	hasRxBacklog, hasTxBacklog bool
+
+	// speed is the link speed in bits per second, or zero if unknown.
+	speed float64
+
+	// mtu is the MTU in bytes, or zero if unknown.
+	mtu float64
+
+	up bool
+
+	// fieldsParsed is how many of the regexps matched, out of
+	// len(defaultIfconfigRegexps).
+	fieldsParsed int
+
+	ipv4 string
+	ipv6 string
+}
+
+var (
+	ifaceNameRe  = regexp.MustCompile(`(?m)^(\S+)`)
+	ifaceLinkRe  = regexp.MustCompile(`(?m)^(\S+)\s+Link encap`)
+	ifaceFlagsRe = regexp.MustCompile(`(?m)^\s+([A-Z ]*?)\s*MTU:`)
+	rxBytesRe    = regexp.MustCompile(`RX bytes:(\d+)`)
+	rxPacketsRe  = regexp.MustCompile(`RX packets:(\d+)`)
+	txBytesRe    = regexp.MustCompile(`TX bytes:(\d+)`)
+	txPacketsRe  = regexp.MustCompile(`TX packets:(\d+)`)
+
+	inetRe  = regexp.MustCompile(`inet addr:\s*(\S+)`)
+	inet6Re = regexp.MustCompile(`inet6 addr:\s*([^\s/]+)`)
+
+	collisionsRe = regexp.MustCompile(`collisions:(\d+)`)
+	txQueueLenRe = regexp.MustCompile(`txqueuelen:(\d+)`)
+
+	rxBacklogRe = regexp.MustCompile(`RX (?:dropped \()?backlog\)?:\s*(\d+)`)
+	txBacklogRe = regexp.MustCompile(`TX (?:dropped \()?backlog\)?:\s*(\d+)`)
+
+	mtuRe = regexp.MustCompile(`MTU:(\d+)`)
+
+	speedRe = regexp.MustCompile(`(?i)speed[:=]?\s*(\d+(?:\.\d+)?)\s*([kmg])b(?:it)?(?:/s|ps)`)
+)
+
+// speedUnits are the multipliers of the units speedRe matches.
+var speedUnits = map[string]float64{
+	"k": 1e3,
+	"m": 1e6,
+	"g": 1e9,
+}
@@ -0,0 +1,308 @@
+package sonos
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// ifconfigSample is /status/ifconfig's Command from a Play:1.
+const ifconfigSample = `lo        Link encap:Local Loopback
+          inet addr:127.0.0.1  Mask:255.0.0.0
+          UP LOOPBACK RUNNING  MTU:16436  Metric:1
+          RX packets:1558 errors:0 dropped:0 overruns:0 frame:0
+          TX packets:1558 errors:0 dropped:0 overruns:0 carrier:0
+          collisions:0 txqueuelen:0
+          RX bytes:263284 (257.1 KiB)  TX bytes:263284 (257.1 KiB)
+
+eth0      Link encap:Ethernet  HWaddr 78:28:CA:0F:8B:0A
+          inet addr:192.168.1.20  Bcast:192.168.1.255  Mask:255.255.255.0
+          UP BROADCAST RUNNING MULTICAST  MTU:1500  Metric:1
+          RX packets:3894622 errors:0 dropped:0 overruns:0 frame:0
+          TX packets:2197347 errors:0 dropped:0 overruns:0 carrier:0
+          collisions:0 txqueuelen:1000
+          RX bytes:1380493743 (1.2 GiB)  TX bytes:300617442 (286.6 MiB)
+`
+
+// ifconfigResponse wraps command as /status/ifconfig serves it.
+func ifconfigResponse(command string) string {
+	return `<?xml version="1.0" ?><ZPSupportInfo><Command cmdline="/sbin/ifconfig">` +
+		command + `</Command></ZPSupportInfo>`
+}
+
+// fetchIfconfig fetches the ifconfig output command from a fake speaker.
+func fetchIfconfig(t *testing.T, command string) (map[string]stats, error) {
+	t.Helper()
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/status/ifconfig": serve(ifconfigResponse(command)),
+	})
+
+	c := NewCollector(nil).(*collector)
+	return c.fetcher.fetchIfconfig(context.Background(), &url.URL{Scheme: "http", Host: target})
+}
+
+func TestFetchIfconfig(t *testing.T) {
+	ifaces, err := fetchIfconfig(t, ifconfigSample)
+	if err != nil {
+		t.Fatalf("fetchIfconfig: %s", err)
+	}
+
+	if len(ifaces) != 2 {
+		t.Fatalf("got interfaces %v, want lo and eth0", ifaces)
+	}
+
+	eth0 := ifaces["eth0"]
+	if eth0.rxBytes != 1380493743 || eth0.txBytes != 300617442 {
+		t.Errorf("eth0 bytes = %v/%v, want 1380493743/300617442", eth0.rxBytes, eth0.txBytes)
+	}
+	if eth0.rxPackets != 3894622 || eth0.txPackets != 2197347 {
+		t.Errorf("eth0 packets = %v/%v, want 3894622/2197347", eth0.rxPackets, eth0.txPackets)
+	}
+	if !eth0.up || eth0.ipv4 != "192.168.1.20" {
+		t.Errorf("eth0 up = %v, ipv4 = %q; want true, 192.168.1.20", eth0.up, eth0.ipv4)
+	}
+}
+
+func TestFetchIfconfig_Legacy(t *testing.T) {
+	// Very old ZonePlayers 404 on /status/ifconfig, serving it under /zp.
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/zp/status/ifconfig": serve(ifconfigResponse(ifconfigSample)),
+	})
+
+	f := NewCollector(nil).(*collector).fetcher
+	ifaces, err := f.fetchIfconfig(context.Background(), &url.URL{Scheme: "http", Host: target})
+	if err != nil {
+		t.Fatalf("fetchIfconfig: %s", err)
+	}
+	if _, ok := ifaces["eth0"]; !ok {
+		t.Errorf("got interfaces %v, want eth0 from the legacy path", ifaces)
+	}
+
+	// Other errors aren't retried at the legacy path.
+	target = newSpeaker(t, map[string]http.HandlerFunc{
+		"/status/ifconfig":    fail(http.StatusInternalServerError),
+		"/zp/status/ifconfig": serve(ifconfigResponse(ifconfigSample)),
+	})
+	if _, err := f.fetchIfconfig(context.Background(), &url.URL{Scheme: "http", Host: target}); err == nil {
+		t.Errorf("fetchIfconfig with a 500 at /status/ifconfig: got no error")
+	}
+}
+
+func TestFetchIfconfig_Backlog(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		command string
+		has     [2]bool
+		rx, tx  float64
+	}{
+		{"none", ifconfigSample, [2]bool{false, false}, 0, 0},
+		{
+			"both",
+			strings.Replace(ifconfigSample, "collisions:0 txqueuelen:1000", "collisions:0 txqueuelen:1000\n          RX backlog:0  TX backlog:12", 1),
+			[2]bool{true, true}, 0, 12,
+		},
+		{
+			"dropped",
+			strings.Replace(ifconfigSample, "collisions:0 txqueuelen:1000", "collisions:0 txqueuelen:1000\n          RX dropped (backlog):3", 1),
+			[2]bool{true, false}, 3, 0,
+		},
+	} {
+		ifaces, err := fetchIfconfig(t, tt.command)
+		if err != nil {
+			t.Fatalf("%s: fetchIfconfig: %s", tt.name, err)
+		}
+
+		eth0 := ifaces["eth0"]
+		if got := [2]bool{eth0.hasRxBacklog, eth0.hasTxBacklog}; got != tt.has {
+			t.Errorf("%s: eth0 has backlogs %v, want %v", tt.name, got, tt.has)
+		}
+		if eth0.rxBacklog != tt.rx || eth0.txBacklog != tt.tx {
+			t.Errorf("%s: eth0 backlogs = %v/%v, want %v/%v", tt.name, eth0.rxBacklog, eth0.txBacklog, tt.rx, tt.tx)
+		}
+
+		// lo reports none either way.
+		if lo := ifaces["lo"]; lo.hasRxBacklog || lo.hasTxBacklog {
+			t.Errorf("%s: got backlogs for lo", tt.name)
+		}
+	}
+}
+
+func TestFetchIfconfig_CRLF(t *testing.T) {
+	// The XML decoder turns raw CRLFs into LFs itself, so escape the
+	// CRs to have them reach the parser.
+	ifaces, err := fetchIfconfig(t, strings.ReplaceAll(ifconfigSample, "\n", "&#13;\n"))
+	if err != nil {
+		t.Fatalf("fetchIfconfig: %s", err)
+	}
+
+	for _, name := range []string{"lo", "eth0"} {
+		s, ok := ifaces[name]
+		if !ok {
+			t.Errorf("no %s in %v", name, ifaces)
+			continue
+		}
+		if s.fieldsParsed != len(defaultIfconfigRegexps) {
+			t.Errorf("%s: parsed %d fields, want %d", name, s.fieldsParsed, len(defaultIfconfigRegexps))
+		}
+	}
+	if len(ifaces) != 2 {
+		t.Errorf("got interfaces %v, want lo and eth0", ifaces)
+	}
+}
+
+func TestIfconfigRegexps(t *testing.T) {
+	for _, tt := range []struct {
+		field, text string
+		want        float64
+	}{
+		{"rx_bytes", "RX bytes:1380493743 (1.2 GiB)  TX bytes:300617442 (286.6 MiB)", 1380493743},
+		{"tx_bytes", "RX bytes:1380493743 (1.2 GiB)  TX bytes:300617442 (286.6 MiB)", 300617442},
+		{"collisions", "collisions:0 txqueuelen:1000", 0},
+		{"txqueuelen", "collisions:0 txqueuelen:1000", 1000},
+
+		// Collisions are rare on switched networks, but a half duplex
+		// link to a hub racks them up.
+		{"collisions", "collisions:17 txqueuelen:1000", 17},
+		{"collisions", "collisions:4294967295 txqueuelen:0", 4294967295},
+		{"txqueuelen", "collisions:17 txqueuelen:0", 0},
+	} {
+		m := defaultIfconfigRegexps[tt.field].FindStringSubmatch(tt.text)
+		if len(m) < 2 {
+			t.Errorf("%s: no match in %q", tt.field, tt.text)
+			continue
+		}
+		if got := atof(m[1]); got != tt.want {
+			t.Errorf("%s in %q = %v, want %v", tt.field, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestMTURegexp(t *testing.T) {
+	// The flags lines of ifconfigSample's lo and eth0.
+	for _, tt := range []struct {
+		text string
+		want float64
+	}{
+		{"          UP LOOPBACK RUNNING  MTU:16436  Metric:1", 16436},
+		{"          UP BROADCAST RUNNING MULTICAST  MTU:1500  Metric:1", 1500},
+	} {
+		m := mtuRe.FindStringSubmatch(tt.text)
+		if len(m) < 2 {
+			t.Errorf("no MTU in %q", tt.text)
+			continue
+		}
+		if got := atof(m[1]); got != tt.want {
+			t.Errorf("MTU in %q = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestIfaceName(t *testing.T) {
+	for _, tt := range []struct {
+		text, want string
+	}{
+		{"eth0      Link encap:Ethernet  HWaddr 78:28:CA:0F:8B:0A\n          UP BROADCAST RUNNING MULTICAST  MTU:1500", "eth0"},
+
+		// A block whose first line is a misgrouped continuation is
+		// named by its Link encap line, not the address.
+		{"          inet6 addr: fe80::7a28:caff:fe0f:8b0a/64 Scope:Link\nath0      Link encap:Ethernet  HWaddr 78:28:CA:0F:8B:0B", "ath0"},
+
+		// Without Link encap, the first word at column 0.
+		{"  RX packets:0 errors:0\nbr0       UP BROADCAST  MTU:1500", "br0"},
+
+		// Nothing at column 0 names nothing.
+		{"          inet addr:192.168.1.20  Bcast:192.168.1.255\n          UP  MTU:1500", ""},
+	} {
+		if got := ifaceName(tt.text); got != tt.want {
+			t.Errorf("ifaceName(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// ipv6OnlyLoopback is a loopback block from firmware that gives lo no
+// IPv4 address.
+const ipv6OnlyLoopback = `lo        Link encap:Local Loopback
+          inet6 addr: ::1/128 Scope:Host
+          UP LOOPBACK RUNNING  MTU:16436  Metric:1
+          RX packets:1558 errors:0 dropped:0 overruns:0 frame:0
+          TX packets:1558 errors:0 dropped:0 overruns:0 carrier:0
+          collisions:0 txqueuelen:0
+          RX bytes:263284 (257.1 KiB)  TX bytes:263284 (257.1 KiB)
+`
+
+func TestCollect_IPv6Only(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(ifconfigResponse(ipv6OnlyLoopback)),
+	})
+
+	metrics := gather(t, NewCollector([]string{target}))
+
+	addrs := metrics["sonos_interface_address_info"]
+	if len(addrs) != 1 {
+		t.Fatalf("got %d sonos_interface_address_info, want 1", len(addrs))
+	}
+
+	want := map[string]string{"player": "Kitchen", "device": "lo", "ipv4": "", "ipv6": "::1"}
+	got := labels(addrs[0])
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("sonos_interface_address_info %s = %q, want %q", name, got[name], v)
+		}
+	}
+}
+
+func TestCollect_IfconfigMalformed(t *testing.T) {
+	// The Command decodes, but the document breaks off after it.
+	malformed := strings.TrimSuffix(ifconfigResponse(ifconfigSample), "</ZPSupportInfo>") + "<Command cmdline="
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(malformed),
+	})
+
+	metrics := gather(t, NewCollector([]string{target}))
+
+	if got := len(metrics["sonos_rx_bytes"]); got != 2 {
+		t.Errorf("got %d sonos_rx_bytes, want one each for lo and eth0", got)
+	}
+
+	ups := metrics["sonos_up"]
+	if len(ups) != 1 || value(ups[0]) != 0 {
+		t.Errorf("sonos_up = %v, want a single 0", ups)
+	}
+}
+
+func TestCollect_ZeroCollisions(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(ifconfigResponse(ifconfigSample)),
+	})
+
+	metrics := gather(t, NewCollector([]string{target}))
+
+	// Every interface gets both, zero or not, so the series have no gaps.
+	want := map[string]map[string]float64{
+		"sonos_collisions_total": {"lo": 0, "eth0": 0},
+		"sonos_tx_queue_len":     {"lo": 0, "eth0": 1000},
+	}
+	for name, devices := range want {
+		got := make(map[string]float64)
+		for _, m := range metrics[name] {
+			got[labels(m)["device"]] = value(m)
+		}
+		if len(got) != len(devices) {
+			t.Errorf("%s = %v, want %v", name, got, devices)
+			continue
+		}
+		for device, v := range devices {
+			if g, ok := got[device]; !ok || g != v {
+				t.Errorf("%s = %v, want %v", name, got, devices)
+				break
+			}
+		}
+	}
+}
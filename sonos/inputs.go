@@ -0,0 +1,62 @@
+package sonos
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lineInConnected = prometheus.NewDesc(
+	"sonos_line_in_connected", "Whether the home theater speaker's TV input is receiving audio, playing or not",
+	[]string{"player", "serial_num"},
+	nil,
+)
+
+// fetchHTAudioIn returns the audio format arriving at the TV input of
+// the speaker at base, from DeviceProperties' GetZoneInfo. It's 0 when
+// nothing is.
+func (f *httpFetcher) fetchHTAudioIn(ctx context.Context, base *url.URL, d *Device) (int, error) {
+	var resp struct {
+		HTAudioIn string `xml:"HTAudioIn"`
+	}
+	err := f.soapCall(ctx, base, d, devicePropertiesService, "GetZoneInfo", nil, &resp)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(resp.HTAudioIn))
+}
+
+// collectLineIn emits whether a home theater speaker's TV input is
+// receiving audio. Only speakers with the HTControl service have one;
+// line-in on other models is only reported through AudioIn events, which
+// the exporter doesn't subscribe to.
+func (c *collector) collectLineIn(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device, player, serial string) {
+	if d == nil || !d.hasService(htControlService) {
+		return
+	}
+
+	format, err := c.fetcher.fetchHTAudioIn(ctx, base, d)
+	if err != nil {
+		log.Printf("Get zone info %s: %s", base, err)
+		c.fail(base.Host, "line_in", err)
+		return
+	}
+
+	var connected float64
+	if format != 0 {
+		connected = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		lineInConnected,
+		prometheus.GaugeValue,
+		connected,
+		player,
+		serial,
+	)
+}
@@ -0,0 +1,149 @@
+package sonos
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// LocalInfo is the subset of the local API's players/local/info response
+// the collector uses.
+type LocalInfo struct {
+	HouseholdID string `json:"householdId"`
+	PlayerID    string `json:"playerId"`
+	GroupID     string `json:"groupId"`
+	Device      struct {
+		ID              string `json:"id"`
+		Name            string `json:"name"`
+		Model           string `json:"model"`
+		SerialNumber    string `json:"serialNumber"`
+		SoftwareVersion string `json:"softwareVersion"`
+		APIVersion      string `json:"apiVersion"`
+		SWGen           int    `json:"swGen"`
+	} `json:"device"`
+}
+
+// LocalVolume is the local API's playerVolume response.
+type LocalVolume struct {
+	Volume float64 `json:"volume"`
+	Muted  bool    `json:"muted"`
+	Fixed  bool    `json:"fixed"`
+}
+
+// LocalPlayback is the subset of the local API's playback response, for
+// the speaker's group, the collector uses.
+type LocalPlayback struct {
+	PlaybackState string `json:"playbackState"`
+}
+
+// localTransportStates maps the local API's playback states to the
+// AVTransport states sonos_transport_state reports.
+var localTransportStates = map[string]string{
+	"PLAYBACK_STATE_IDLE":      "STOPPED",
+	"PLAYBACK_STATE_BUFFERING": "TRANSITIONING",
+	"PLAYBACK_STATE_PAUSED":    "PAUSED_PLAYBACK",
+	"PLAYBACK_STATE_PLAYING":   "PLAYING",
+}
+
+// fetchLocalAPI gets path from the local API on newer firmware, served
+// over HTTPS on port 1443, and decodes its JSON response into v.
+func (f *httpFetcher) fetchLocalAPI(ctx context.Context, base *url.URL, path string, v interface{}) error {
+	u := url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(base.Hostname(), "1443"),
+		Path:   path,
+	}
+
+	ctx, cancel := f.requestContext(ctx, base, f.stages.Device)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Sonos-Api-Key", f.localAPIKey)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f.limitBody(resp)
+
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchLocalInfo asks the local API about the speaker at base, including
+// the IDs its other endpoints take.
+func (f *httpFetcher) fetchLocalInfo(ctx context.Context, base *url.URL) (*LocalInfo, error) {
+	var info LocalInfo
+	if err := f.fetchLocalAPI(ctx, base, "/api/v1/players/local/info", &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// fetchLocalVolume asks the local API for a player's volume and mute.
+func (f *httpFetcher) fetchLocalVolume(ctx context.Context, base *url.URL, playerID string) (*LocalVolume, error) {
+	var v LocalVolume
+	if err := f.fetchLocalAPI(ctx, base, "/api/v1/players/"+url.PathEscape(playerID)+"/playerVolume", &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// fetchLocalPlayback asks the local API for a group's playback state.
+func (f *httpFetcher) fetchLocalPlayback(ctx context.Context, base *url.URL, groupID string) (*LocalPlayback, error) {
+	var p LocalPlayback
+	if err := f.fetchLocalAPI(ctx, base, "/api/v1/groups/"+url.PathEscape(groupID)+"/playback", &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// localState is what the local API answered about a speaker in one
+// scrape. Either field is nil where it didn't, leaving that to SOAP.
+type localState struct {
+	volume   *LocalVolume
+	playback *LocalPlayback
+}
+
+// collectLocal asks the local API for the speaker's volume and playback,
+// or returns nil if it's off or the speaker doesn't have it. A speaker
+// without it is expected on older firmware, so that's only logged.
+func (c *collector) collectLocal(ctx context.Context, base *url.URL) *localState {
+	if !c.localAPI {
+		return nil
+	}
+
+	info, err := c.fetcher.fetchLocalInfo(ctx, base)
+	if err != nil {
+		c.infof("Local API %s: %s, falling back to SOAP", base.Host, err)
+		return nil
+	}
+
+	var state localState
+	if state.volume, err = c.fetcher.fetchLocalVolume(ctx, base, info.PlayerID); err != nil {
+		c.infof("Local API volume %s: %s, falling back to SOAP", base.Host, err)
+	}
+	if state.playback, err = c.fetcher.fetchLocalPlayback(ctx, base, info.GroupID); err != nil {
+		c.infof("Local API playback %s: %s, falling back to SOAP", base.Host, err)
+	}
+	return &state
+}
+
+// transportState returns the AVTransport state matching the local API's
+// playback state, if it answered with a known one.
+func (s *localState) transportState() (string, bool) {
+	if s == nil || s.playback == nil {
+		return "", false
+	}
+	state, ok := localTransportStates[s.playback.PlaybackState]
+	return state, ok
+}
@@ -0,0 +1,75 @@
+package sonos
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCollect_LocalAPI(t *testing.T) {
+	// The local API is always on port 1443 of the speaker's address.
+	l, err := net.Listen("tcp", "127.0.0.1:1443")
+	if err != nil {
+		t.Skipf("Can't listen on the local API's port: %s", err)
+	}
+
+	const key = "test-key"
+	mux := http.NewServeMux()
+	for path, body := range map[string]string{
+		"/api/v1/players/local/info":                            `{"householdId":"Sonos_test","playerId":"RINCON_7828CA0F8B0A01400","groupId":"RINCON_7828CA0F8B0A01400:7"}`,
+		"/api/v1/players/RINCON_7828CA0F8B0A01400/playerVolume": `{"_objectType":"playerVolume","volume":42,"muted":true,"fixed":false}`,
+		"/api/v1/groups/RINCON_7828CA0F8B0A01400:7/playback":    `{"_objectType":"playbackStatus","playbackState":"PLAYBACK_STATE_PAUSED"}`,
+	} {
+		body := body
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Sonos-Api-Key") != key {
+				http.Error(w, "bad key", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(body))
+		})
+	}
+	local := httptest.NewUnstartedServer(mux)
+	local.Listener.Close()
+	local.Listener = l
+	local.StartTLS()
+	t.Cleanup(local.Close)
+
+	// SOAP answers differently, so what's exported shows which was used.
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(ifconfigResponse(ifconfigSample)),
+		"/MediaRenderer/RenderingControl/Control": soapHandler(map[string]string{
+			"GetVolume": soapResponse(volumeResponse),
+			"GetMute":   soapResponse(`<u:GetMuteResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentMute>0</CurrentMute></u:GetMuteResponse>`),
+		}),
+		"/MediaRenderer/AVTransport/Control": soapHandler(map[string]string{
+			"GetTransportInfo": soapResponse(`<u:GetTransportInfoResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1"><CurrentTransportState>PLAYING</CurrentTransportState></u:GetTransportInfoResponse>`),
+		}),
+	})
+
+	for _, tt := range []struct {
+		key    string
+		volume float64
+		mute   float64
+		state  string
+	}{
+		{key, 42, 1, "PAUSED_PLAYBACK"},
+
+		// Refused by the local API, so SOAP answers.
+		{"wrong-key", 23, 0, "PLAYING"},
+	} {
+		metrics := gather(t, NewCollector([]string{target}, WithLocalAPI(tt.key)))
+
+		if vols := metrics["sonos_volume"]; len(vols) != 1 || value(vols[0]) != tt.volume {
+			t.Errorf("key %s: sonos_volume = %v, want %v", tt.key, vols, tt.volume)
+		}
+		if mutes := metrics["sonos_mute"]; len(mutes) != 1 || value(mutes[0]) != tt.mute {
+			t.Errorf("key %s: sonos_mute = %v, want %v", tt.key, mutes, tt.mute)
+		}
+		if states := metrics["sonos_transport_state"]; len(states) != 1 || labels(states[0])["state"] != tt.state {
+			t.Errorf("key %s: sonos_transport_state = %v, want state %s", tt.key, states, tt.state)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fixedOutput = prometheus.NewDesc(
+		"sonos_fixed_output", "Whether the speaker's line-out is set to fixed volume, leaving volume to the amplifier it feeds",
+		[]string{"player", "serial_num"},
+		nil,
+	)
+
+	volume = prometheus.NewDesc(
+		"sonos_volume", "The speaker's master volume, 0 to 100",
+		[]string{"player", "serial_num", "coordinator_room"},
+		nil,
+	)
+
+	mute = prometheus.NewDesc(
+		"sonos_mute", "Whether the speaker is muted",
+		[]string{"player", "serial_num", "coordinator_room"},
+		nil,
+	)
+)
+
+// fetchVolume returns the master volume of the speaker at base.
+func (f *httpFetcher) fetchVolume(ctx context.Context, base *url.URL, d *Device) (float64, error) {
+	var resp struct {
+		CurrentVolume string `xml:"CurrentVolume"`
+	}
+	args := []soapArg{{"InstanceID", "0"}, {"Channel", "Master"}}
+	if err := f.soapCall(ctx, base, d, renderingControlService, "GetVolume", args, &resp); err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(resp.CurrentVolume), 64)
+}
+
+// fetchMute returns whether the speaker at base is muted.
+func (f *httpFetcher) fetchMute(ctx context.Context, base *url.URL, d *Device) (bool, error) {
+	var resp struct {
+		CurrentMute string `xml:"CurrentMute"`
+	}
+	args := []soapArg{{"InstanceID", "0"}, {"Channel", "Master"}}
+	if err := f.soapCall(ctx, base, d, renderingControlService, "GetMute", args, &resp); err != nil {
+		return false, err
+	}
+
+	return upnpBool(resp.CurrentMute), nil
+}
+
+// fetchOutputFixed returns whether the speaker at base supports fixed
+// volume output, and if so whether it's turned on. Only speakers with a
+// line-out (Connect, Port, Amp) support it.
+func (f *httpFetcher) fetchOutputFixed(ctx context.Context, base *url.URL, d *Device) (supported, fixed bool, err error) {
+	args := []soapArg{{"InstanceID", "0"}}
+
+	var supports struct {
+		CurrentSupportsFixed string `xml:"CurrentSupportsFixed"`
+	}
+	err = f.soapCall(ctx, base, d, renderingControlService, "GetSupportsOutputFixed", args, &supports)
+	if err != nil || !upnpBool(supports.CurrentSupportsFixed) {
+		return false, false, err
+	}
+
+	var resp struct {
+		CurrentFixed string `xml:"CurrentFixed"`
+	}
+	err = f.soapCall(ctx, base, d, renderingControlService, "GetOutputFixed", args, &resp)
+	if err != nil {
+		return true, false, err
+	}
+
+	return true, upnpBool(resp.CurrentFixed), nil
+}
+
+// upnpBool parses a UPnP boolean, which may be 0/1, true/false or
+// yes/no.
+func upnpBool(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "true", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// collectRendering emits the speaker's RenderingControl settings. Speakers
+// that don't support an output setting get no metric for it. local, if
+// not nil, has what the local API answered. coordinator is the room of
+// the speaker's group coordinator.
+func (c *collector) collectRendering(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device, local *localState, player, serial, coordinator string) {
+	c.collectVolume(ctx, ch, base, d, local, player, serial, coordinator)
+	c.collectMute(ctx, ch, base, d, local, player, serial, coordinator)
+
+	supported, fixed, err := c.fetcher.fetchOutputFixed(ctx, base, d)
+	if err != nil {
+		log.Printf("Get output fixed %s: %s", base, err)
+		c.fail(base.Host, "rendering", err)
+		return
+	}
+	if !supported {
+		return
+	}
+
+	var v float64
+	if fixed {
+		v = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		fixedOutput,
+		prometheus.GaugeValue,
+		v,
+		player,
+		serial,
+	)
+}
+
+// collectVolume emits the speaker's master volume, as last reported by
+// events if eventing is on, or else by the local API if it answered. A
+// speaker that answers SOAP with a fault, as those without a Master
+// channel do, has no volume to report rather than a failure.
+func (c *collector) collectVolume(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device, local *localState, player, serial, coordinator string) {
+	v, ok := c.eventVolume(base)
+	if !ok && local != nil && local.volume != nil {
+		v, ok = local.volume.Volume, true
+	}
+	if !ok {
+		var err error
+		v, err = c.fetcher.fetchVolume(ctx, base, d)
+		if err != nil {
+			var fault *soapFault
+			if errors.As(err, &fault) {
+				c.infof("Get volume %s: %s", base, err)
+				return
+			}
+			log.Printf("Get volume %s: %s", base, err)
+			c.fail(base.Host, "rendering", err)
+			return
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		volume,
+		prometheus.GaugeValue,
+		v,
+		player,
+		serial,
+		coordinator,
+	)
+}
+
+// collectMute emits whether the speaker is muted, as last reported by
+// events if eventing is on, or else by the local API. Like volume, a
+// fault means there's nothing to report.
+func (c *collector) collectMute(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device, local *localState, player, serial, coordinator string) {
+	muted, ok := c.eventMute(base)
+	if !ok && local != nil && local.volume != nil {
+		muted, ok = local.volume.Muted, true
+	}
+	if !ok {
+		var err error
+		muted, err = c.fetcher.fetchMute(ctx, base, d)
+		if err != nil {
+			var fault *soapFault
+			if errors.As(err, &fault) {
+				c.infof("Get mute %s: %s", base, err)
+				return
+			}
+			log.Printf("Get mute %s: %s", base, err)
+			c.fail(base.Host, "rendering", err)
+			return
+		}
+	}
+
+	var v float64
+	if muted {
+		v = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		mute,
+		prometheus.GaugeValue,
+		v,
+		player,
+		serial,
+		coordinator,
+	)
+}
@@ -0,0 +1,73 @@
+package sonos
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// volumeResponse is GetVolume's response for a volume of 23.
+const volumeResponse = `<u:GetVolumeResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentVolume>23</CurrentVolume></u:GetVolumeResponse>`
+
+func TestCollect_Volume(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		name   string
+		volume bool
+		want   []float64
+	}{
+		{"volume", true, []float64{23}},
+
+		// A speaker without a Master channel answers with a fault,
+		// which leaves the volume out without counting as an error.
+		{"fault", false, nil},
+	} {
+		responses := map[string]string{
+			"GetMute":                soapResponse(`<u:GetMuteResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentMute>0</CurrentMute></u:GetMuteResponse>`),
+			"GetSupportsOutputFixed": soapResponse(`<u:GetSupportsOutputFixedResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentSupportsFixed>0</CurrentSupportsFixed></u:GetSupportsOutputFixedResponse>`),
+		}
+		if tt.volume {
+			responses["GetVolume"] = soapResponse(volumeResponse)
+		}
+
+		target := newSpeaker(t, map[string]http.HandlerFunc{
+			"/xml/device_description.xml":             serve(deviceDescription),
+			"/status/ifconfig":                        serve(ifconfigResponse(ifconfigSample)),
+			"/MediaRenderer/RenderingControl/Control": soapHandler(responses),
+		})
+
+		buf.Reset()
+		metrics := gather(t, NewCollector([]string{target}, WithQuiet()))
+
+		// The fault comes back on every scrape, so quiet leaves it unlogged.
+		if strings.Contains(buf.String(), "Get volume") {
+			t.Errorf("%s: logged a volume fault with WithQuiet", tt.name)
+		}
+
+		vols := metrics["sonos_volume"]
+		if len(vols) != len(tt.want) {
+			t.Errorf("%s: got %d sonos_volume, want %d", tt.name, len(vols), len(tt.want))
+			continue
+		}
+		for i, m := range vols {
+			if value(m) != tt.want[i] {
+				t.Errorf("%s: sonos_volume = %v, want %v", tt.name, value(m), tt.want[i])
+			}
+			if got := labels(m)["serial_num"]; got != "78-28-CA-0F-8B-0A:3" {
+				t.Errorf("%s: sonos_volume serial_num = %q, want the speaker's", tt.name, got)
+			}
+		}
+
+		for _, m := range metrics["sonos_collection_errors_total"] {
+			if labels(m)["stage"] == "rendering" {
+				t.Errorf("%s: counted a rendering error", tt.name)
+			}
+		}
+	}
+}
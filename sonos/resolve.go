@@ -0,0 +1,81 @@
+package sonos
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultResolveTTL is how long hostnames are cached when there's no
+// discovery TTL to follow.
+const defaultResolveTTL = 5 * time.Minute
+
+// countLookup counts a DNS lookup of type "forward" or "reverse" in
+// lookups, and in errors too if it failed.
+func countLookup(lookups, errors *prometheus.CounterVec, typ string, err error) {
+	lookups.WithLabelValues(typ).Inc()
+	if err != nil {
+		errors.WithLabelValues(typ).Inc()
+	}
+}
+
+// hostResolver looks up speakers' hostnames by reverse DNS, caching
+// each answer, failures included, for ttl.
+type hostResolver struct {
+	ttl time.Duration
+
+	// lookups and errors, if set, count the reverse lookups made.
+	lookups, errors *prometheus.CounterVec
+
+	mu      sync.Mutex
+	entries map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	name    string
+	expires time.Time
+}
+
+func newHostResolver(ttl time.Duration) *hostResolver {
+	if ttl <= 0 {
+		ttl = defaultResolveTTL
+	}
+	return &hostResolver{
+		ttl:     ttl,
+		entries: make(map[string]resolvedHost),
+	}
+}
+
+// hostname returns host's name, or "" if it can't be resolved. A host
+// that's already a name rather than an IP address is returned as is.
+func (r *hostResolver) hostname(ctx context.Context, host string) string {
+	if net.ParseIP(host) == nil {
+		return host
+	}
+
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.name
+	}
+
+	var name string
+	names, err := net.DefaultResolver.LookupAddr(ctx, host)
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	if r.lookups != nil {
+		countLookup(r.lookups, r.errors, "reverse", err)
+	}
+
+	r.mu.Lock()
+	r.entries[host] = resolvedHost{name: name, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	return name
+}
@@ -0,0 +1,121 @@
+package sonos
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	alarmClockService        = "urn:schemas-upnp-org:service:AlarmClock:1"
+	devicePropertiesService  = "urn:schemas-upnp-org:service:DeviceProperties:1"
+	zoneGroupTopologyService = "urn:schemas-upnp-org:service:ZoneGroupTopology:1"
+	htControlService         = "urn:schemas-upnp-org:service:HTControl:1"
+	renderingControlService  = "urn:schemas-upnp-org:service:RenderingControl:1"
+	avTransportService       = "urn:schemas-upnp-org:service:AVTransport:1"
+)
+
+// wellKnownControlPaths are where Sonos firmware has always served each
+// service, for devices whose description doesn't list it.
+var wellKnownControlPaths = map[string]string{
+	alarmClockService:        "/AlarmClock/Control",
+	devicePropertiesService:  "/DeviceProperties/Control",
+	zoneGroupTopologyService: "/ZoneGroupTopology/Control",
+	htControlService:         "/HTControl/Control",
+	renderingControlService:  "/MediaRenderer/RenderingControl/Control",
+	avTransportService:       "/MediaRenderer/AVTransport/Control",
+}
+
+// soapArg is a single named argument to a SOAP action. Arguments are
+// kept in order since UPnP actions expect them as declared.
+type soapArg struct {
+	name  string
+	value string
+}
+
+// soapFault is a SOAP fault returned by a speaker, as for an action or
+// argument it doesn't support.
+type soapFault struct {
+	url, action string
+	msg, code   string
+}
+
+func (f *soapFault) Error() string {
+	return fmt.Sprintf("%s %s: %s (UPnP error %s)", f.url, f.action, f.msg, f.code)
+}
+
+// soapCall invokes action on the UPnP service of the speaker at base,
+// decoding the action's response element into out. The service's control
+// URL comes from d, which may be nil if its description isn't known.
+// Failures are counted in sonos_soap_errors_total by action.
+func (f *httpFetcher) soapCall(ctx context.Context, base *url.URL, d *Device, service, action string, args []soapArg, out interface{}) error {
+	err := f.doSOAPCall(ctx, base, d, service, action, args, out)
+	if err != nil && f.soapErrors != nil {
+		f.soapErrors.WithLabelValues(action).Inc()
+	}
+	return err
+}
+
+func (f *httpFetcher) doSOAPCall(ctx context.Context, base *url.URL, d *Device, service, action string, args []soapArg, out interface{}) error {
+	u, err := speakerURL(base, d.controlURL(service))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	buf.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&buf, `<u:%s xmlns:u="%s">`, action, service)
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "<%s>", arg.name)
+		xml.EscapeText(&buf, []byte(arg.value))
+		fmt.Fprintf(&buf, "</%s>", arg.name)
+	}
+	fmt.Fprintf(&buf, `</u:%s>`, action)
+	buf.WriteString(`</s:Body></s:Envelope>`)
+
+	ctx, cancel := f.requestContext(ctx, base, f.stages.SOAP)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, service, action))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f.limitBody(resp)
+
+	var env struct {
+		Body struct {
+			Fault *struct {
+				String string `xml:"faultstring"`
+				Code   string `xml:"detail>UPnPError>errorCode"`
+			} `xml:"Fault"`
+			Response []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := f.newDecoder(resp.Body).Decode(&env); err != nil {
+		return fmt.Errorf("%s %s: %s: %w", u.String(), action, resp.Status, err)
+	}
+
+	if f := env.Body.Fault; f != nil {
+		return &soapFault{url: u.String(), action: action, msg: f.String, code: f.Code}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", u.String(), action, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return f.newDecoder(bytes.NewReader(env.Body.Response)).Decode(out)
+}
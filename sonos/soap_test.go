@@ -0,0 +1,79 @@
+package sonos
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+// soapResponse wraps an action's response element in a SOAP envelope.
+func soapResponse(body string) string {
+	return `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		body + `</s:Body></s:Envelope>`
+}
+
+func TestSOAPCall_OtherHost(t *testing.T) {
+	var elsewhere atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhere.Add(1)
+	}))
+	defer other.Close()
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/MediaRenderer/RenderingControl/Control": serve(soapResponse(
+			`<u:GetVolumeResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentVolume>23</CurrentVolume></u:GetVolumeResponse>`)),
+	})
+
+	// A description whose control URL points at another host only gets
+	// the speaker itself asked.
+	d := &Device{Services: []Service{{
+		ServiceType: renderingControlService,
+		ControlURL:  other.URL + "/MediaRenderer/RenderingControl/Control",
+	}}}
+
+	f := NewCollector(nil).(*collector).fetcher
+	v, err := f.fetchVolume(context.Background(), &url.URL{Scheme: "http", Host: target}, d)
+	if err != nil {
+		t.Fatalf("fetchVolume: %s", err)
+	}
+	if v != 23 {
+		t.Errorf("fetchVolume = %v, want 23", v)
+	}
+	if n := elsewhere.Load(); n != 0 {
+		t.Errorf("the other host got %d requests, want 0", n)
+	}
+}
+
+func TestCollect_SOAPFails(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml":             serve(deviceDescription),
+		"/status/ifconfig":                        serve(ifconfigResponse(ifconfigSample)),
+		"/MediaRenderer/RenderingControl/Control": soapHandler(nil),
+	})
+
+	metrics := gather(t, NewCollector([]string{target}))
+
+	ups := metrics["sonos_up"]
+	if len(ups) != 1 || value(ups[0]) != 1 {
+		t.Errorf("sonos_up = %v, want a single 1", ups)
+	}
+	if got := len(metrics["sonos_rx_bytes"]); got != 2 {
+		t.Errorf("got %d sonos_rx_bytes, want one each for lo and eth0", got)
+	}
+	if got := len(metrics["sonos_volume"]); got != 0 {
+		t.Errorf("got %d sonos_volume with GetVolume failing, want 0", got)
+	}
+
+	var failed bool
+	for _, m := range metrics["sonos_soap_errors_total"] {
+		if labels(m)["action"] == "GetVolume" && value(m) == 1 {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Errorf("no sonos_soap_errors_total for GetVolume")
+	}
+}
@@ -0,0 +1,208 @@
+package sonos
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ssdpMaxResponse is the largest SSDP response read so far. Responses
+// near the 64KB read buffer size may have been truncated.
+var ssdpMaxResponse atomic.Int64
+
+// defaultSSDPBackoff is how long Search first waits after a transient
+// read error.
+const defaultSSDPBackoff = 50 * time.Millisecond
+
+// Search performs an SDDP query via multicast.
+func Search(ctx context.Context, query string) ([]http.Header, error) {
+	found, err := searchWithBackoff(ctx, query, defaultSSDPBackoff, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]http.Header, 0, len(found))
+	for _, r := range found {
+		headers = append(headers, r.header)
+	}
+	return headers, nil
+}
+
+// ssdpResponse is a response to an SSDP search.
+type ssdpResponse struct {
+	header http.Header
+
+	// ip is the address the response came from, and latency how long
+	// after the search was sent it arrived.
+	ip      string
+	latency time.Duration
+}
+
+// searchWithBackoff is Search with the first wait after a transient
+// read error and the multicast TTL, which is left at the OS default
+// (normally 1, the local segment) if zero. quiet leaves out the log
+// lines for transient errors.
+func searchWithBackoff(ctx context.Context, query string, backoff time.Duration, ttl int, quiet bool) ([]ssdpResponse, error) {
+	// The search goes to an IPv4 multicast group, so ask for an IPv4
+	// socket. Left to "udp", dual-stack hosts may hand out an IPv6
+	// socket that some OSes (macOS among them) won't send IPv4 multicast
+	// from, and the search silently finds nothing.
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if ttl > 0 {
+		if err := setConnMulticastTTL(conn, ttl); err != nil {
+			return nil, fmt.Errorf("set multicast TTL: %w", err)
+		}
+	}
+
+	return search(ctx, conn, query, backoff, quiet)
+}
+
+// setConnMulticastTTL sets how many routers the multicast packets sent
+// on conn may cross.
+func setConnMulticastTTL(conn *net.UDPConn, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = setMulticastTTL(fd, ttl)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// search sends query on conn and reads responses until the deadline.
+// Read errors other than the deadline passing or conn being closed are
+// taken as transient, like an ICMP port unreachable surfacing on the
+// socket: search waits a jittered, doubling backoff and keeps reading.
+// They're routine on busy networks, so quiet leaves them out of the log.
+func search(ctx context.Context, conn net.PacketConn, query string, backoff time.Duration, quiet bool) ([]ssdpResponse, error) {
+	req := strings.Join([]string{
+		"M-SEARCH * HTTP/1.1",
+		"HOST: 239.255.255.250:1900",
+		"MAN: \"ssdp:discover\"",
+		"ST: " + query,
+		"MX: 1",
+	}, "\r\n")
+
+	addr, err := net.ResolveUDPAddr("udp4", "239.255.255.250:1900")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.WriteTo([]byte(req), addr)
+	if err != nil {
+		return nil, err
+	}
+	sent := time.Now()
+
+	deadline := time.Now().Add(2 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Bound backoff sleeps by the read deadline too.
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var (
+		devices []ssdpResponse
+		wait    = backoff
+	)
+	for {
+		buf := make([]byte, 65536)
+
+		n, from, err := conn.ReadFrom(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			break
+		} else if errors.Is(err, net.ErrClosed) {
+			log.Printf("ReadFrom error: %s", err)
+			break
+		} else if err != nil {
+			if !quiet {
+				log.Printf("ReadFrom error, retrying in %s: %s", wait, err)
+			}
+			if !sleepJittered(ctx, wait) {
+				break
+			}
+			wait *= 2
+			continue
+		}
+		wait = backoff
+		latency := time.Since(sent)
+
+		for max := ssdpMaxResponse.Load(); int64(n) > max; max = ssdpMaxResponse.Load() {
+			if ssdpMaxResponse.CompareAndSwap(max, int64(n)) {
+				break
+			}
+		}
+
+		r := bufio.NewReader(bytes.NewReader(buf[:n]))
+
+		resp, err := http.ReadResponse(r, &http.Request{})
+		if err != nil {
+			log.Printf("ReadResponse error: %s", err)
+			continue
+		}
+		resp.Body.Close()
+
+		for _, head := range resp.Header["St"] {
+			if head == query {
+				devices = append(devices, ssdpResponse{
+					header:  resp.Header,
+					ip:      addrIP(from),
+					latency: latency,
+				})
+				break
+			}
+		}
+	}
+
+	return devices, nil
+}
+
+// addrIP returns the IP address of addr, which is normally a UDP
+// address, or its string form if it has no port.
+func addrIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// sleepJittered sleeps for a random duration between half and one and a
+// half times d, returning false if ctx is done first.
+func sleepJittered(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(time.Duration(float64(d) * (0.5 + rand.Float64())))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
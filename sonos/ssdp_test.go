@@ -0,0 +1,93 @@
+package sonos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePacketConn is a PacketConn whose reads return each of reads in
+// turn, then time out.
+type fakePacketConn struct {
+	net.PacketConn
+	reads []fakeRead
+}
+
+type fakeRead struct {
+	data string
+	err  error
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(c.reads) == 0 {
+		return 0, nil, timeoutError{}
+	}
+
+	r := c.reads[0]
+	c.reads = c.reads[1:]
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
+	n := copy(p, r.data)
+	return n, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 1900}, nil
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func (c *fakePacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+const zonePlayer = "urn:schemas-upnp-org:device:ZonePlayer:1"
+
+// ssdpReply is a ZonePlayer's response to a search.
+const ssdpReply = "HTTP/1.1 200 OK\r\n" +
+	"CACHE-CONTROL: max-age = 1800\r\n" +
+	"LOCATION: http://192.168.1.20:1400/xml/device_description.xml\r\n" +
+	"ST: " + zonePlayer + "\r\n" +
+	"USN: uuid:RINCON_7828CA0F8B0A01400::" + zonePlayer + "\r\n" +
+	"\r\n"
+
+func TestSearch_TransientError(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		var logs bytes.Buffer
+		out := log.Writer()
+		log.SetOutput(&logs)
+
+		conn := &fakePacketConn{reads: []fakeRead{
+			{err: errors.New("read udp4: connection refused")},
+			{data: ssdpReply},
+		}}
+		found, err := search(context.Background(), conn, zonePlayer, time.Millisecond, quiet)
+
+		log.SetOutput(out)
+
+		if err != nil {
+			t.Fatalf("quiet=%v: search: %s", quiet, err)
+		}
+
+		// The response after the error is still read.
+		if len(found) != 1 || found[0].header.Get("Location") != "http://192.168.1.20:1400/xml/device_description.xml" {
+			t.Errorf("quiet=%v: found %v, want the one response", quiet, found)
+		}
+
+		logged := strings.Contains(logs.String(), "connection refused")
+		if logged == quiet {
+			t.Errorf("quiet=%v: logged the transient error: %v", quiet, logged)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package sonos
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateSaveInterval is the least time between saves of the state file.
+const stateSaveInterval = time.Minute
+
+// state is what the collector keeps in its state file, so reset
+// detection carries on across exporter restarts.
+type state struct {
+	// Interfaces are the byte counts last seen on each interface.
+	Interfaces []interfaceState `json:"interfaces"`
+
+	// Resets are the counts behind sonos_counter_resets_total.
+	Resets []resetState `json:"resets"`
+}
+
+type interfaceState struct {
+	Target  string  `json:"target"`
+	Device  string  `json:"device"`
+	RxBytes float64 `json:"rx_bytes"`
+	TxBytes float64 `json:"tx_bytes"`
+}
+
+type resetState struct {
+	Player string  `json:"player"`
+	Device string  `json:"device"`
+	Count  float64 `json:"count"`
+}
+
+// loadState restores the last byte counts and reset counts from the
+// state file. A missing file is a first run, not an error.
+func (c *collector) loadState() error {
+	data, err := os.ReadFile(c.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+
+	c.lastMu.Lock()
+	defer c.lastMu.Unlock()
+
+	for _, i := range st.Interfaces {
+		c.lastBytes[[2]string{i.Target, i.Device}] = [2]float64{i.RxBytes, i.TxBytes}
+	}
+	for _, r := range st.Resets {
+		c.resets[[2]string{r.Player, r.Device}] = r.Count
+		c.counterResets.WithLabelValues(r.Player, r.Device).Add(r.Count)
+	}
+
+	c.infof("Loaded state for %d interfaces from %s", len(st.Interfaces), c.stateFile)
+	return nil
+}
+
+// maybeSaveState writes the state file if it hasn't been written in the
+// last stateSaveInterval. Failures are logged; the next scrape tries
+// again.
+func (c *collector) maybeSaveState() {
+	c.lastMu.Lock()
+	if time.Since(c.stateSaved) < stateSaveInterval {
+		c.lastMu.Unlock()
+		return
+	}
+	c.stateSaved = time.Now()
+
+	var st state
+	for key, b := range c.lastBytes {
+		st.Interfaces = append(st.Interfaces, interfaceState{key[0], key[1], b[0], b[1]})
+	}
+	for key, n := range c.resets {
+		st.Resets = append(st.Resets, resetState{key[0], key[1], n})
+	}
+	c.lastMu.Unlock()
+
+	if err := writeState(c.stateFile, st); err != nil {
+		log.Printf("Saving state to %s: %s", c.stateFile, err)
+	}
+}
+
+// writeState replaces the file at path with st. It writes a temporary
+// file and renames it over path, so a crash midway leaves the previous
+// state intact.
+func writeState(path string, st state) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,257 @@
+package sonos
+
+import (
+	"context"
+	"log"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	groupSize = prometheus.NewDesc(
+		"sonos_group_size", "Number of speakers in the group, counting both of a stereo pair and a home theater's satellites",
+		[]string{"coordinator"},
+		nil,
+	)
+
+	householdsDiscovered = prometheus.NewDesc(
+		"sonos_households_discovered", "Number of distinct households among collected speakers",
+		nil,
+		nil,
+	)
+
+	bondedSatellites = prometheus.NewDesc(
+		"sonos_bonded_satellites", "Number of speakers bonded to the room's primary: 1 for a stereo pair, the surrounds and sub for a home theater",
+		[]string{"player"},
+		nil,
+	)
+)
+
+// ZoneGroup is a group of speakers playing together, from the
+// ZoneGroupTopology service. A standalone speaker is a group of one.
+type ZoneGroup struct {
+	ID          string            `xml:"ID,attr"`
+	Coordinator string            `xml:"Coordinator,attr"`
+	Members     []ZoneGroupMember `xml:"ZoneGroupMember"`
+}
+
+// ZoneGroupMember is a speaker in a ZoneGroup. Its UUID is its UDN
+// without the "uuid:" prefix. Home theater surrounds and subs are
+// satellites of the member they're bonded to. The second speaker of a
+// stereo pair is a member of its own, invisible and under the same
+// ZoneName.
+type ZoneGroupMember struct {
+	UUID       string            `xml:"UUID,attr"`
+	Location   string            `xml:"Location,attr"`
+	ZoneName   string            `xml:"ZoneName,attr"`
+	Invisible  string            `xml:"Invisible,attr"`
+	Satellites []ZoneGroupMember `xml:"Satellite"`
+}
+
+// visible reports whether the Sonos app shows m. Stereo pair partners,
+// satellites and Boosts and Bridges, which are groups of their own, are
+// invisible.
+func (m ZoneGroupMember) visible() bool {
+	return m.Invisible != "1"
+}
+
+// speakers returns the group's members and their satellites, skipping
+// any left without a UUID, as members that vanished mid-change can be.
+func (g ZoneGroup) speakers() []ZoneGroupMember {
+	var speakers []ZoneGroupMember
+	for _, m := range g.Members {
+		if m.UUID != "" {
+			speakers = append(speakers, m)
+		}
+		for _, sat := range m.Satellites {
+			if sat.UUID != "" {
+				speakers = append(speakers, sat)
+			}
+		}
+	}
+	return speakers
+}
+
+// visible reports whether any of g's members is shown in the Sonos app.
+// Groups of only invisible members are Boosts and Bridges, which don't
+// play anything.
+func (g ZoneGroup) visible() bool {
+	for _, m := range g.Members {
+		if m.UUID != "" && m.visible() {
+			return true
+		}
+	}
+	return false
+}
+
+// coordinatorRoom returns the room of g's coordinator, or its UUID if
+// it isn't among the members.
+func (g ZoneGroup) coordinatorRoom() string {
+	for _, m := range g.Members {
+		if m.UUID == g.Coordinator && m.ZoneName != "" {
+			return m.ZoneName
+		}
+	}
+	return g.Coordinator
+}
+
+// fetchZoneGroups returns the groups in the household of the speaker at
+// base. Every speaker knows the whole household's topology.
+func (f *httpFetcher) fetchZoneGroups(ctx context.Context, base *url.URL, d *Device) ([]ZoneGroup, error) {
+	var resp struct {
+		ZoneGroupState string `xml:"ZoneGroupState"`
+	}
+	err := f.soapCall(ctx, base, d, zoneGroupTopologyService, "GetZoneGroupState", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the alarm list, the state is an escaped XML document. Newer
+	// firmware wraps the groups in a ZoneGroupState element; older
+	// firmware's root is ZoneGroups itself.
+	var state struct {
+		Groups    []ZoneGroup `xml:"ZoneGroups>ZoneGroup"`
+		OldGroups []ZoneGroup `xml:"ZoneGroup"`
+	}
+	if err := f.unmarshal(resp.ZoneGroupState, &state); err != nil {
+		return nil, err
+	}
+
+	if len(state.Groups) == 0 {
+		return state.OldGroups, nil
+	}
+	return state.Groups, nil
+}
+
+// topology is the groups in each household among a scrape's targets.
+type topology struct {
+	households [][]ZoneGroup
+
+	// coordinators maps each speaker's UUID to the room of its group's
+	// coordinator.
+	coordinators map[string]string
+}
+
+// coordinatorRoom returns the room of the coordinator of d's group, for
+// the coordinator_room label of the playback metrics. Without topology,
+// or for a speaker it doesn't list, that's player: a standalone speaker
+// coordinates itself.
+func (t *topology) coordinatorRoom(d *Device, player string) string {
+	if t == nil || d == nil {
+		return player
+	}
+	if room, ok := t.coordinators[normalizeUDN(d.UDN)]; ok {
+		return room
+	}
+	return player
+}
+
+// fetchTopology fetches the groups of the households among locs. It runs
+// before the targets are collected, so that their playback metrics can
+// name their coordinator's room, which means the speakers' descriptions
+// aren't known yet and the topology's control URL is the well known one.
+// A location is only asked if no topology fetched so far lists it, so
+// each household is normally queried once; one listing speakers already
+// seen, as a target given by host name can, isn't counted again. Like
+// any other fetch, each holds a concurrency slot.
+func (c *collector) fetchTopology(ctx context.Context, locs []string) *topology {
+	t := &topology{coordinators: make(map[string]string)}
+	listed := make(map[string]bool)
+
+	for _, loc := range locs {
+		if listed[loc] {
+			continue
+		}
+
+		base, err := url.Parse(loc)
+		if err != nil {
+			continue
+		}
+
+		if !c.acquire(ctx) {
+			break
+		}
+		groups, err := c.fetcher.fetchZoneGroups(ctx, base, nil)
+		c.release()
+		if err != nil {
+			log.Printf("Get zone groups %s: %s", loc, err)
+			c.fail(base.Host, "topology", err)
+			continue
+		}
+		listed[loc] = true
+
+		known := false
+		for _, g := range groups {
+			for _, m := range g.speakers() {
+				if _, ok := t.coordinators[m.UUID]; ok {
+					known = true
+				}
+				listed[m.Location] = true
+			}
+		}
+		if known {
+			continue
+		}
+
+		for _, g := range groups {
+			room := g.coordinatorRoom()
+			for _, m := range g.speakers() {
+				t.coordinators[m.UUID] = room
+			}
+		}
+		t.households = append(t.households, groups)
+	}
+
+	return t
+}
+
+// collectTopology emits the groups of each household in t.
+func collectTopology(ch chan<- prometheus.Metric, t *topology) {
+	for _, groups := range t.households {
+		for _, g := range groups {
+			if !g.visible() {
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				groupSize,
+				prometheus.GaugeValue,
+				float64(len(g.speakers())),
+				g.coordinatorRoom(),
+			)
+
+			// Both speakers of a stereo pair are members under the same
+			// room name, so emit each room once. Each speaker in a room
+			// beyond the first, pair partner or home theater satellite,
+			// is bonded to it.
+			var rooms []string
+			speakers := make(map[string]int)
+			for _, m := range g.Members {
+				if m.UUID == "" {
+					continue
+				}
+				if _, ok := speakers[m.ZoneName]; !ok {
+					rooms = append(rooms, m.ZoneName)
+				}
+				speakers[m.ZoneName]++
+				for _, sat := range m.Satellites {
+					if sat.UUID != "" {
+						speakers[m.ZoneName]++
+					}
+				}
+			}
+
+			for _, room := range rooms {
+				ch <- prometheus.MustNewConstMetric(
+					bondedSatellites,
+					prometheus.GaugeValue,
+					float64(speakers[room]-1),
+					room,
+				)
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(householdsDiscovered, prometheus.GaugeValue, float64(len(t.households)))
+}
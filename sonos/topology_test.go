@@ -0,0 +1,176 @@
+package sonos
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// homeTheater is a household's ZoneGroupState with a 5.1 home theater
+// (an Arc with a Sub and two surrounds as satellites), a stereo pair and
+// a Boost. The pair's second speaker is an invisible member of its own.
+const homeTheater = `<ZoneGroupState><ZoneGroups>
+  <ZoneGroup Coordinator="RINCON_ARC01400" ID="RINCON_ARC01400:12">
+    <ZoneGroupMember UUID="RINCON_ARC01400" Location="http://192.168.1.30:1400/xml/device_description.xml" ZoneName="Living Room">
+      <Satellite UUID="RINCON_SUB01400" Location="http://192.168.1.31:1400/xml/device_description.xml" ZoneName="Living Room" Invisible="1"/>
+      <Satellite UUID="RINCON_LS01400" Location="http://192.168.1.32:1400/xml/device_description.xml" ZoneName="Living Room" Invisible="1"/>
+      <Satellite UUID="RINCON_RS01400" Location="http://192.168.1.33:1400/xml/device_description.xml" ZoneName="Living Room" Invisible="1"/>
+    </ZoneGroupMember>
+  </ZoneGroup>
+  <ZoneGroup Coordinator="RINCON_7828CA0F8B0A01400" ID="RINCON_7828CA0F8B0A01400:7">
+    <ZoneGroupMember UUID="RINCON_7828CA0F8B0A01400" Location="http://192.168.1.20:1400/xml/device_description.xml" ZoneName="Kitchen"/>
+    <ZoneGroupMember UUID="RINCON_7828CA0F8B0B01400" Location="http://192.168.1.21:1400/xml/device_description.xml" ZoneName="Kitchen" Invisible="1"/>
+  </ZoneGroup>
+  <ZoneGroup Coordinator="RINCON_BOOST01400" ID="RINCON_BOOST01400:2">
+    <ZoneGroupMember UUID="RINCON_BOOST01400" Location="http://192.168.1.40:1400/xml/device_description.xml" ZoneName="BOOST" Invisible="1"/>
+  </ZoneGroup>
+</ZoneGroups></ZoneGroupState>`
+
+// zoneGroupStateResponse is GetZoneGroupState's response with state,
+// which comes escaped.
+func zoneGroupStateResponse(state string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(state))
+
+	return soapResponse(`<u:GetZoneGroupStateResponse xmlns:u="urn:schemas-upnp-org:service:ZoneGroupTopology:1"><ZoneGroupState>` +
+		escaped.String() + `</ZoneGroupState></u:GetZoneGroupStateResponse>`)
+}
+
+func TestFetchZoneGroups(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/ZoneGroupTopology/Control": serve(zoneGroupStateResponse(homeTheater)),
+	})
+
+	f := NewCollector(nil).(*collector).fetcher
+	groups, err := f.fetchZoneGroups(context.Background(), &url.URL{Scheme: "http", Host: target}, nil)
+	if err != nil {
+		t.Fatalf("fetchZoneGroups: %s", err)
+	}
+
+	if len(groups) != 3 {
+		t.Fatalf("got %d groups, want 3", len(groups))
+	}
+
+	for i, want := range []struct {
+		speakers int
+		visible  bool
+	}{
+		{4, true},  // The Arc and its three satellites.
+		{2, true},  // Both speakers of the pair.
+		{1, false}, // The Boost.
+	} {
+		g := groups[i]
+		if got := len(g.speakers()); got != want.speakers {
+			t.Errorf("group %s: %d speakers, want %d", g.ID, got, want.speakers)
+		}
+		if got := g.visible(); got != want.visible {
+			t.Errorf("group %s: visible = %v, want %v", g.ID, got, want.visible)
+		}
+	}
+}
+
+func TestFetchZoneGroups_Vanished(t *testing.T) {
+	// A member that left mid-change can linger without a UUID, and
+	// doesn't count.
+	const state = `<ZoneGroupState><ZoneGroups>
+  <ZoneGroup Coordinator="RINCON_7828CA0F8B0A01400" ID="RINCON_7828CA0F8B0A01400:8">
+    <ZoneGroupMember UUID="RINCON_7828CA0F8B0A01400" ZoneName="Kitchen"/>
+    <ZoneGroupMember ZoneName="Den"/>
+  </ZoneGroup>
+</ZoneGroups></ZoneGroupState>`
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/ZoneGroupTopology/Control": serve(zoneGroupStateResponse(state)),
+	})
+
+	f := NewCollector(nil).(*collector).fetcher
+	groups, err := f.fetchZoneGroups(context.Background(), &url.URL{Scheme: "http", Host: target}, nil)
+	if err != nil {
+		t.Fatalf("fetchZoneGroups: %s", err)
+	}
+
+	if len(groups) != 1 || len(groups[0].speakers()) != 1 {
+		t.Errorf("got groups %+v, want one of one speaker", groups)
+	}
+}
+
+// soapHandler answers each SOAP action with its response in responses,
+// keyed by action name, and anything else with a fault.
+func soapHandler(responses map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+		_, action, _ := strings.Cut(soapAction, "#")
+
+		body, ok := responses[action]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			body = soapResponse(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>` +
+				`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>401</errorCode></UPnPError></detail></s:Fault>`)
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func TestCollect_CoordinatorRoom(t *testing.T) {
+	// The Kitchen speaker has joined the Living Room's group.
+	const state = `<ZoneGroupState><ZoneGroups>
+  <ZoneGroup Coordinator="RINCON_ARC01400" ID="RINCON_ARC01400:13">
+    <ZoneGroupMember UUID="RINCON_ARC01400" Location="http://192.168.1.30:1400/xml/device_description.xml" ZoneName="Living Room"/>
+    <ZoneGroupMember UUID="RINCON_7828CA0F8B0A01400" Location="http://192.168.1.20:1400/xml/device_description.xml" ZoneName="Kitchen"/>
+  </ZoneGroup>
+</ZoneGroups></ZoneGroupState>`
+
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(deviceDescription),
+		"/status/ifconfig":            serve(ifconfigResponse(ifconfigSample)),
+		"/ZoneGroupTopology/Control":  serve(zoneGroupStateResponse(state)),
+		"/MediaRenderer/RenderingControl/Control": soapHandler(map[string]string{
+			"GetVolume": soapResponse(`<u:GetVolumeResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentVolume>23</CurrentVolume></u:GetVolumeResponse>`),
+			"GetMute":   soapResponse(`<u:GetMuteResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1"><CurrentMute>0</CurrentMute></u:GetMuteResponse>`),
+		}),
+		"/MediaRenderer/AVTransport/Control": soapHandler(map[string]string{
+			"GetTransportInfo": soapResponse(`<u:GetTransportInfoResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1"><CurrentTransportState>PLAYING</CurrentTransportState></u:GetTransportInfoResponse>`),
+		}),
+	})
+
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{WithTopology()}, "Living Room"},
+
+		// Without topology, every speaker is taken as standalone.
+		{nil, "Kitchen"},
+	} {
+		metrics := gather(t, NewCollector([]string{target}, tt.opts...))
+
+		for _, name := range []string{"sonos_volume", "sonos_mute", "sonos_transport_state"} {
+			ms := metrics[name]
+			if len(ms) != 1 {
+				t.Errorf("got %d %s, want 1", len(ms), name)
+				continue
+			}
+			if got := labels(ms[0])["coordinator_room"]; got != tt.want {
+				t.Errorf("%s coordinator_room = %q, want %q", name, got, tt.want)
+			}
+			if got := labels(ms[0])["serial_num"]; got != "78-28-CA-0F-8B-0A:3" {
+				t.Errorf("%s serial_num = %q, want the speaker's", name, got)
+			}
+		}
+
+		sizes := metrics["sonos_group_size"]
+		if tt.opts == nil {
+			if len(sizes) != 0 {
+				t.Errorf("got sonos_group_size without topology")
+			}
+			continue
+		}
+		if len(sizes) != 1 || value(sizes[0]) != 2 || labels(sizes[0])["coordinator"] != "Living Room" {
+			t.Errorf("sonos_group_size = %v, want 2 for Living Room", sizes)
+		}
+	}
+}
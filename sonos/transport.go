@@ -0,0 +1,66 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var transportState = prometheus.NewDesc(
+	"sonos_transport_state", "The speaker's transport state, such as PLAYING or STOPPED, always 1",
+	[]string{"player", "serial_num", "coordinator_room", "state"},
+	nil,
+)
+
+// fetchTransportState returns the transport state of the speaker at base:
+// PLAYING, PAUSED_PLAYBACK, STOPPED or TRANSITIONING. AVTransport has no
+// action for the state alone; it comes with GetTransportInfo.
+func (f *httpFetcher) fetchTransportState(ctx context.Context, base *url.URL, d *Device) (string, error) {
+	var resp struct {
+		CurrentTransportState string `xml:"CurrentTransportState"`
+	}
+	args := []soapArg{{"InstanceID", "0"}}
+	if err := f.soapCall(ctx, base, d, avTransportService, "GetTransportInfo", args, &resp); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(resp.CurrentTransportState), nil
+}
+
+// collectTransport emits the speaker's transport state, as last reported
+// by events if eventing is on, or else by the local API if local has it.
+// coordinator is the room of the speaker's group coordinator.
+func (c *collector) collectTransport(ctx context.Context, ch chan<- prometheus.Metric, base *url.URL, d *Device, local *localState, player, serial, coordinator string) {
+	state, ok := c.eventTransport(base)
+	if !ok {
+		state, ok = local.transportState()
+	}
+	if !ok {
+		var err error
+		state, err = c.fetcher.fetchTransportState(ctx, base, d)
+		if err != nil {
+			var fault *soapFault
+			if errors.As(err, &fault) {
+				c.infof("Get transport info %s: %s", base, err)
+				return
+			}
+			log.Printf("Get transport info %s: %s", base, err)
+			c.fail(base.Host, "transport", err)
+			return
+		}
+	}
+	if state == "" {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		transportState,
+		prometheus.GaugeValue,
+		1,
+		player, serial, coordinator, state,
+	)
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package sonos
+
+import "errors"
+
+func setMulticastTTL(fd uintptr, ttl int) error {
+	return errors.New("setting the multicast TTL isn't supported on this platform")
+}
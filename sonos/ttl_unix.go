@@ -0,0 +1,9 @@
+//go:build unix
+
+package sonos
+
+import "syscall"
+
+func setMulticastTTL(fd uintptr, ttl int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package sonos
+
+import "syscall"
+
+func setMulticastTTL(fd uintptr, ttl int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+}
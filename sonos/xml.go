@@ -0,0 +1,76 @@
+package sonos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// newDecoder returns an XML decoder for a speaker's response. Besides
+// UTF-8, it reads documents declared as ISO-8859-1, which older firmware
+// uses. With lenientXML set, it also tolerates malformed markup such as
+// undeclared entities, as far as encoding/xml's non-strict mode does.
+func (f *httpFetcher) newDecoder(r io.Reader) *xml.Decoder {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charsetReader
+
+	if f.lenientXML {
+		dec.Strict = false
+		dec.AutoClose = xml.HTMLAutoClose
+		dec.Entity = xml.HTMLEntity
+	}
+
+	return dec
+}
+
+// unmarshal is xml.Unmarshal with the decoder from newDecoder, for the
+// XML documents that SOAP actions return escaped in a string.
+func (f *httpFetcher) unmarshal(data string, v interface{}) error {
+	return f.newDecoder(strings.NewReader(data)).Decode(v)
+}
+
+// charsetReader converts ISO-8859-1 (and its ASCII subset) to UTF-8,
+// where every byte is the code point of the same value.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1", "us-ascii", "ascii":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+}
+
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf bytes.Buffer
+
+	// err is the error that ended reading r, returned along with the
+	// last of buf.
+	err error
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	for l.err == nil && l.buf.Len() < len(p) {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			l.err = err
+			break
+		}
+
+		if b < utf8.RuneSelf {
+			l.buf.WriteByte(b)
+		} else {
+			l.buf.WriteRune(rune(b))
+		}
+	}
+
+	n, _ := l.buf.Read(p)
+	if l.buf.Len() > 0 {
+		return n, nil
+	}
+	return n, l.err
+}
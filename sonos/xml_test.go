@@ -0,0 +1,69 @@
+package sonos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// latin1Description is deviceDescription for a speaker in a room named
+// "Küche", declared and encoded as ISO-8859-1.
+var latin1Description = strings.Replace(
+	strings.Replace(deviceDescription, `encoding="utf-8"`, `encoding="ISO-8859-1"`, 1),
+	"<roomName>Kitchen</roomName>", "<roomName>K\xfcche</roomName>", 1)
+
+func TestFetchDevice_Latin1(t *testing.T) {
+	target := newSpeaker(t, map[string]http.HandlerFunc{
+		"/xml/device_description.xml": serve(latin1Description),
+	})
+
+	f := NewCollector(nil).(*collector).fetcher
+	d, err := f.fetchDevice(context.Background(), &url.URL{Scheme: "http", Host: target, Path: "/xml/device_description.xml"})
+	if err != nil {
+		t.Fatalf("fetchDevice: %s", err)
+	}
+	if d.RoomName != "Küche" {
+		t.Errorf("room = %q, want Küche", d.RoomName)
+	}
+}
+
+// errOnceReader fails once with err, like a dropped connection, and
+// is empty after.
+type errOnceReader struct {
+	err error
+}
+
+func (r *errOnceReader) Read(p []byte) (int, error) {
+	err := r.err
+	r.err = io.EOF
+	return 0, err
+}
+
+func TestLatin1Reader_Error(t *testing.T) {
+	boom := errors.New("connection reset")
+
+	for _, oneByte := range []bool{false, true} {
+		r, err := charsetReader("ISO-8859-1", io.MultiReader(strings.NewReader("K\xfcche"), &errOnceReader{boom}))
+		if err != nil {
+			t.Fatalf("charsetReader: %s", err)
+		}
+		if oneByte {
+			r = iotest.OneByteReader(r)
+		}
+
+		// However the reads are sized, all the data arrives, and then
+		// the error.
+		got, err := io.ReadAll(r)
+		if string(got) != "Küche" {
+			t.Errorf("oneByte=%v: read %q, want Küche", oneByte, got)
+		}
+		if !errors.Is(err, boom) {
+			t.Errorf("oneByte=%v: got error %v, want %v", oneByte, err, boom)
+		}
+	}
+}